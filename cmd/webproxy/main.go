@@ -18,28 +18,61 @@ package main
 */
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	// rule schedules name timezones, Windows hosts and minimal containers have no zoneinfo database of their own
+	_ "time/tzdata"
 
 	"github.com/kardianos/service"
+	"github.com/rhysbryant/proxylink/pkg/accesslog"
+	"github.com/rhysbryant/proxylink/pkg/admin"
+	"github.com/rhysbryant/proxylink/pkg/auth"
 	"github.com/rhysbryant/proxylink/pkg/bridgeserver"
 	"github.com/rhysbryant/proxylink/pkg/config"
+	"github.com/rhysbryant/proxylink/pkg/geoip"
 	"github.com/rhysbryant/proxylink/pkg/httputils"
+	"github.com/rhysbryant/proxylink/pkg/keyring"
+	"github.com/rhysbryant/proxylink/pkg/metrics"
+	"github.com/rhysbryant/proxylink/pkg/mitm"
+	"github.com/rhysbryant/proxylink/pkg/netpolicy"
 	"github.com/rhysbryant/proxylink/pkg/proxy"
 	"github.com/rhysbryant/proxylink/pkg/requestlogging"
 	"github.com/rhysbryant/proxylink/pkg/rulesengine"
+	"github.com/rhysbryant/proxylink/pkg/socks5"
+	"github.com/rhysbryant/proxylink/pkg/transparent"
 	"golang.org/x/crypto/acme/autocert"
 )
 
+const (
+	// how often the keyring file is checked for changes
+	keyringPollInterval = 10 * time.Second
+	// how often the config file is checked for changes when watchConfig is set
+	configPollInterval = 10 * time.Second
+	// how long connections may take to finish when stopping, unless shutdownTimeout is set
+	defaultShutdownTimeout = 30 * time.Second
+)
+
 // Program structure for service
 type program struct {
-	server *http.Server
-	config *config.Config
+	server      *http.Server
+	socksServer *socks5.Server
+	tpServer    *transparent.Server
+	adminServer *admin.Server
+	tracker     *requestlogging.RequestTrackingWrapper
+	accessLog   *accesslog.Logger
+	config      *config.Config
 }
 
 func (p *program) Start(s service.Service) error {
@@ -49,6 +82,27 @@ func (p *program) Start(s service.Service) error {
 }
 
 func (p *program) run() {
+	if p.socksServer != nil {
+		go func() {
+			log.Printf("Starting SOCKS5 server on %s\n", p.config.Socks.ListenAddr)
+			fatalIfFailed(p.socksServer.ListenAndServe(p.config.Socks.ListenAddr))
+		}()
+	}
+
+	if p.adminServer != nil {
+		go func() {
+			log.Printf("Starting admin server on %s\n", p.config.Admin.ListenAddr)
+			fatalIfFailed(p.adminServer.ListenAndServe(p.config.Admin.ListenAddr))
+		}()
+	}
+
+	if p.tpServer != nil {
+		go func() {
+			log.Printf("Starting transparent proxy server on %s\n", p.config.Transparent.ListenAddr)
+			fatalIfFailed(p.tpServer.ListenAndServe(p.config.Transparent.ListenAddr))
+		}()
+	}
+
 	// Start the HTTP server
 	if p.config.TLS.LetsEncrypt {
 		certManager := autocert.Manager{
@@ -59,22 +113,68 @@ func (p *program) run() {
 		p.server.TLSConfig = certManager.TLSConfig()
 
 		log.Printf("Starting proxy server with Let's Encrypt on %s\n", p.config.ListenAddr)
-		log.Fatal(p.server.ListenAndServeTLS("", ""))
+		fatalIfFailed(p.server.ListenAndServeTLS("", ""))
 	} else {
 		log.Printf("Starting proxy server in %s mode on %s\n", p.config.Mode, p.config.ListenAddr)
 		if p.config.TLS.CertFile != "" && p.config.TLS.KeyFile != "" {
-			log.Fatal(p.server.ListenAndServeTLS(p.config.TLS.CertFile, p.config.TLS.KeyFile))
+			fatalIfFailed(p.server.ListenAndServeTLS(p.config.TLS.CertFile, p.config.TLS.KeyFile))
 		} else {
-			log.Fatal(p.server.ListenAndServe())
+			fatalIfFailed(p.server.ListenAndServe())
 		}
 	}
 }
 
+// fatalIfFailed exits when a listener stops for any reason other than being shut down
+func fatalIfFailed(err error) {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// Stop drains the proxy, new connections are refused while the ones in progress get until the
+// shutdown timeout to finish before they are closed
 func (p *program) Stop(s service.Service) error {
-	// Gracefully shut down the server
+	timeout := p.config.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Printf("Draining connections for up to %s\n", timeout)
+
+	if p.socksServer != nil {
+		if err := p.socksServer.Close(); err != nil {
+			return fmt.Errorf("failed to stop socks server: %w", err)
+		}
+	}
+	if p.tpServer != nil {
+		if err := p.tpServer.Close(); err != nil {
+			return fmt.Errorf("failed to stop transparent proxy server: %w", err)
+		}
+	}
+
+	// stops the listener and waits for requests that have not been hijacked, tunnels are waited for by the tracker
+	if err := p.server.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("failed to stop server: %w", err)
+	}
+	if err := p.tracker.Drain(ctx); err != nil {
+		slog.Warn("shutdown timeout reached before all connections finished")
+	}
 	if err := p.server.Close(); err != nil {
 		return fmt.Errorf("failed to stop server: %w", err)
 	}
+
+	if p.adminServer != nil {
+		if err := p.adminServer.Close(); err != nil {
+			return fmt.Errorf("failed to stop admin server: %w", err)
+		}
+	}
+	if p.accessLog != nil {
+		if err := p.accessLog.Close(); err != nil {
+			return fmt.Errorf("failed to close access log: %w", err)
+		}
+	}
 	log.Println("Server stopped")
 	return nil
 }
@@ -85,6 +185,134 @@ func setIfEmpty(value *string, otherValue string) {
 	}
 }
 
+// decodeKey parses a hex encoded 32-byte key
+func decodeKey(key string) ([]byte, error) {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ws-key: %w", err)
+	}
+	if len(keyBytes) != 32 {
+		return nil, fmt.Errorf("ws-key must be 32 bytes long, got %d", len(keyBytes))
+	}
+	return keyBytes, nil
+}
+
+// newExitNode builds the client for an exit node, a node with via set is reached through a tunnel over that node.
+// requireHandshake refuses exit nodes that do not support the key exchange
+func newExitNode(node rulesengine.ExiteNode, defaultKey string, requireHandshake bool) (*proxy.WSBridgeProxyClient, error) {
+	key := node.Key
+	if key == "" {
+		key = defaultKey
+	}
+	keyBytes, err := decodeKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("exit node %s: %w", node.URL, err)
+	}
+
+	client := proxy.NewWSBridgeProxyClient(node.URL, keyBytes)
+	client.SetRequireHandshake(requireHandshake)
+	if node.Via != nil {
+		if node.Via.Group != "" {
+			return nil, fmt.Errorf("exit node %s: via must be a single node", node.URL)
+		}
+		// each hop has its own key, the relay only sees an encrypted tunnel to the next node
+		via, err := newExitNode(*node.Via, "", requireHandshake)
+		if err != nil {
+			return nil, err
+		}
+		client.SetVia(via)
+	}
+	return client, nil
+}
+
+// newExitGroup builds the provider for an exit group and starts its health checks
+func newExitGroup(name string, group rulesengine.ExitGroup, requireHandshake bool) (*proxy.ExitGroup, error) {
+	var clients []*proxy.WSBridgeProxyClient
+	for _, node := range group.Nodes {
+		client, err := newExitNode(node, group.Key, requireHandshake)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	eg, err := proxy.NewExitGroup(name, proxy.Strategy(group.Strategy), clients)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := group.HealthCheck
+	if interval <= 0 {
+		interval = proxy.DefaultHealthCheckInterval
+	}
+	eg.StartHealthChecks(interval)
+	return eg, nil
+}
+
+// newAccessLog opens the access log configured by cfg, nil is returned if it is disabled
+func newAccessLog(cfg config.AccessLogConfig) (*accesslog.Logger, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+
+	// the logger closes its output when it is a file, stdout is hidden behind a plain writer so it stays open
+	var out io.Writer = struct{ io.Writer }{os.Stdout}
+	if cfg.File != "-" {
+		file, err := accesslog.NewRotatingFile(cfg.File, accesslog.RotateOptions{
+			MaxSize:    cfg.MaxSize * 1024 * 1024,
+			Every:      cfg.RotateEvery,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAge,
+			Compress:   cfg.Compress,
+		})
+		if err != nil {
+			return nil, err
+		}
+		out = file
+	}
+	return accesslog.NewLogger(out, accesslog.Format(cfg.Format), cfg.Template)
+}
+
+// newGeoIP opens the databases rules look up countries and autonomous systems in, lookups are nil for those not configured
+func newGeoIP(cfg config.GeoIPConfig) (rulesengine.GeoIP, error) {
+	var geo rulesengine.GeoIP
+	if cfg.CountryDB != "" {
+		db, err := geoip.OpenCountry(cfg.CountryDB)
+		if err != nil {
+			return geo, err
+		}
+		geo.Country = db.Country
+	}
+	if cfg.ASNDB != "" {
+		db, err := geoip.OpenASN(cfg.ASNDB)
+		if err != nil {
+			return geo, err
+		}
+		geo.ASN = db.ASN
+	}
+	return geo, nil
+}
+
+// newNextHop builds the provider for --next, a comma separated list of addresses forms an exit group
+func newNextHop(nextProxyAddr string, strategy string, key []byte, requireHandshake bool) (httputils.RequestProcessor, error) {
+	var clients []*proxy.WSBridgeProxyClient
+	for _, url := range strings.Split(nextProxyAddr, ",") {
+		client := proxy.NewWSBridgeProxyClient(strings.TrimSpace(url), key)
+		client.SetRequireHandshake(requireHandshake)
+		clients = append(clients, client)
+	}
+	if len(clients) == 1 {
+		return clients[0], nil
+	}
+
+	eg, err := proxy.NewExitGroup("next", proxy.Strategy(strategy), clients)
+	if err != nil {
+		return nil, err
+	}
+	eg.StartHealthChecks(proxy.DefaultHealthCheckInterval)
+	return eg, nil
+}
+
 func main() {
 	// Define CLI flags
 	var mode string
@@ -99,17 +327,41 @@ func main() {
 	var domain string
 	var serviceFlag string
 	var logFormat string
+	var socksListenAddr string
+	var transparentListenAddr string
+	var keyringFileName string
+	var requireHandshake bool
+	var requireExitHandshake bool
+	var nextStrategy string
+	var nextKey string
+	var adminListenAddr string
+	var watchConfig bool
+	var shutdownTimeout time.Duration
+	var accessLogFile string
+	var accessLogFormat string
 
 	flag.StringVar(&mode, "mode", "standalone", "Mode of operation: standalone, bridge, or exit")
-	flag.StringVar(&nextProxyAddr, "next", "", "Address of the next proxy (required in bridge mode)")
+	flag.StringVar(&nextProxyAddr, "next", "", "Address of the next proxy (required in bridge mode), a comma separated list forms an exit group")
+	flag.StringVar(&nextStrategy, "next-strategy", string(proxy.StrategyFailover), "How requests are spread when --next lists several exit nodes: failover, round-robin, least-connections or latency")
 	var listenAddr string
 	flag.StringVar(&listenAddr, "listen", ":8080", "Address to listen on")
+	flag.StringVar(&socksListenAddr, "socks-listen", "", "Address for the SOCKS5 listener (optional)")
+	flag.StringVar(&adminListenAddr, "admin-listen", "", "Address for the admin listener serving /metrics and the admin API (optional)")
+	flag.StringVar(&transparentListenAddr, "transparent-listen", "", "Address for the transparent proxy listener, linux only (optional)")
 	flag.StringVar(&certFile, "tls-cert", "", "Path to TLS certificate file")
 	flag.StringVar(&keyFile, "tls-key", "", "Path to TLS key file")
+	flag.StringVar(&nextKey, "next-key", "", "32-byte key for the hop to the next exit node when an exit node relays with --next (optional)")
 	flag.StringVar(&wsKey, "ws-key", "", "32-byte key for encrypting WebSocket traffic (optional)")
+	flag.StringVar(&keyringFileName, "keyring", "", "Path to a file of named client keys (exit mode, optional)")
+	flag.BoolVar(&requireHandshake, "require-handshake", false, "Refuse bridges that do not support the forward secret key exchange (exit mode)")
+	flag.BoolVar(&requireExitHandshake, "require-exit-handshake", true, "Refuse exit nodes that do not support the forward secret key exchange, false falls back to the pre-shared key")
 	flag.StringVar(&logLevel, "log-level", "error", "Logging level: debug, info, warn, error")
 	flag.StringVar(&logFormat, "log-format", "text", "Log format: text or json")
 	flag.StringVar(&configFileName, "config", "config.yml", "Path to configuration file")
+	flag.BoolVar(&watchConfig, "watch-config", false, "Reload rules and exit nodes when the configuration file changes")
+	flag.StringVar(&accessLogFile, "access-log", "", "Path of the access log, - for stdout (optional)")
+	flag.StringVar(&accessLogFormat, "access-log-format", "", "Access log format: common, combined, json or template (default combined)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 0, "How long connections may take to finish when stopping (default 30s)")
 	flag.BoolVar(&useLetsEncrypt, "lets-encrypt", false, "Enable Let's Encrypt support")
 	flag.StringVar(&domain, "domain", "", "Domain name for Let's Encrypt (required if --lets-encrypt is enabled)")
 	flag.StringVar(&serviceFlag, "service", "", "Control the system service (install, uninstall, start, stop)")
@@ -121,13 +373,30 @@ func main() {
 		slog.Error("failed to load config:", "error", err)
 		cfg = &config.Config{}
 	}
+	// the file's own settings, reloads are compared against these rather than the command line overrides
+	fileCfg := *cfg
 
 	setIfEmpty(&cfg.ListenAddr, listenAddr)
 	setIfEmpty(&cfg.Mode, mode)
+	setIfEmpty(&cfg.Socks.ListenAddr, socksListenAddr)
+	setIfEmpty(&cfg.Transparent.ListenAddr, transparentListenAddr)
+	setIfEmpty(&cfg.Admin.ListenAddr, adminListenAddr)
+	setIfEmpty(&cfg.Keyring, keyringFileName)
 	setIfEmpty(&cfg.TLS.CertFile, certFile)
 	setIfEmpty(&cfg.TLS.KeyFile, keyFile)
 	cfg.TLS.LetsEncrypt = useLetsEncrypt
+	cfg.RequireHandshake = cfg.RequireHandshake || requireHandshake
+	if cfg.RequireExitHandshake == nil {
+		cfg.RequireExitHandshake = &requireExitHandshake
+	}
+	setIfEmpty(&cfg.NextKey, nextKey)
+	cfg.WatchConfig = cfg.WatchConfig || watchConfig
+	if shutdownTimeout != 0 {
+		cfg.ShutdownTimeout = shutdownTimeout
+	}
 	setIfEmpty(&cfg.TLS.Domain, domain)
+	setIfEmpty(&cfg.AccessLog.File, accessLogFile)
+	setIfEmpty(&cfg.AccessLog.Format, accessLogFormat)
 
 	// Configure logging
 	var handler slog.Handler
@@ -171,50 +440,183 @@ func main() {
 		log.Fatal("Domain name must be specified when using Let's Encrypt")
 	}
 
+	var nextHop httputils.RequestProcessor
+	if cfg.Mode == "bridge" || (cfg.Mode == "exit" && nextProxyAddr != "") {
+		key := wsKeyBytes
+		if cfg.Mode == "exit" {
+			// a relay uses a separate key for the hop to the next exit node
+			key = nil
+			if cfg.NextKey != "" {
+				if key, err = decodeKey(cfg.NextKey); err != nil {
+					log.Fatal("invalid next-key:", err)
+				}
+			}
+		}
+
+		nextHop, err = newNextHop(nextProxyAddr, nextStrategy, key, cfg.ExitHandshakeRequired())
+		if err != nil {
+			log.Fatal("failed to configure next proxy:", err)
+		}
+	}
+
+	direct, err := proxy.NewDirectHTTPProxyWithOptions(cfg.Upstream)
+	if err != nil {
+		log.Fatal("invalid upstream settings:", err)
+	}
+	if cfg.DestinationPolicy.IsEnabled(cfg.Mode) {
+		policy, err := netpolicy.NewPolicy(cfg.DestinationPolicy.Deny, cfg.DestinationPolicy.Allow, cfg.DestinationPolicy.DenyPorts)
+		if err != nil {
+			log.Fatal("invalid destination policy:", err)
+		}
+		direct.SetDestinationPolicy(policy)
+	}
+
+	geo, err := newGeoIP(cfg.GeoIP)
+	if err != nil {
+		log.Fatal("invalid geoip settings:", err)
+	}
+	rt, err := newRouting(configFileName, cfg.Mode, direct, nextHop, geo, cfg.ExitHandshakeRequired(), &fileCfg)
+	if err != nil {
+		log.Fatal("invalid rules:", err)
+	}
+	// plain requests leave with the Via and X-Forwarded-For headers this mode is configured for, whichever provider they use
+	upstream, err := proxy.NewForwardingWrapper(rt.wrapper, cfg.Forwarding.Policy(cfg.Mode))
+	if err != nil {
+		log.Fatal("invalid forwarding settings:", err)
+	}
+
+	// SIGHUP re-reads the rules and exit nodes from the config file without dropping connections
+	go func() {
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		for range hangup {
+			rt.Reload()
+		}
+	}()
+
+	if cfg.WatchConfig {
+		go config.Watch(configFileName, configPollInterval, func() { rt.Reload() })
+	}
+
+	accessLog, err := newAccessLog(cfg.AccessLog)
+	if err != nil {
+		log.Fatal("invalid access log:", err)
+	}
+
 	var rp httputils.RequestProcessor
+	var bs *bridgeserver.BridgeServer
+	// connections listed by the admin API
+	var trackers []admin.ConnectionTracker
+
+	if cfg.Intercept.CACert != "" {
+		ca, err := mitm.LoadCA(cfg.Intercept.CACert, cfg.Intercept.CAKey)
+		if err != nil {
+			log.Fatal("invalid interception CA:", err)
+		}
+		// decrypted requests are tracked and logged on their own and go through the rules like plain requests
+		interceptTracker := requestlogging.NewRequestTrackingWrapper(upstream)
+		interceptTracker.SetAccessLog(accessLog)
+		trackers = append(trackers, interceptTracker)
+		rt.wrapper.SetInterceptor(mitm.NewInterceptor(ca, cfg.Intercept.CacheSize), cfg.Intercept.Enabled, interceptTracker)
+	} else if cfg.Intercept.Enabled {
+		log.Fatal("interception needs a CA certificate and key")
+	}
 
 	switch cfg.Mode {
-	case "standalone":
-		rp = proxy.NewDirectHTTPProxy()
-	case "bridge":
-		rp = proxy.NewWSBridgeProxyClient(nextProxyAddr, wsKeyBytes)
 	case "exit":
-		rp = bridgeserver.NewBridgeServer(wsKeyBytes)
+		if cfg.Keyring != "" {
+			var extraKeys []keyring.Key
+			if wsKey != "" {
+				extraKeys = append(extraKeys, keyring.Key{Name: keyring.DefaultKeyName, Key: wsKey})
+			}
+			kr, err := keyring.LoadKeyring(cfg.Keyring, extraKeys...)
+			if err != nil {
+				log.Fatal("failed to load keyring:", err)
+			}
+			slog.Info("keyring loaded", "keys", kr.Len())
+
+			bs = bridgeserver.NewBridgeServerWithKeyring(kr)
+			// editing the file revokes or adds keys without a restart
+			go keyring.Watch(cfg.Keyring, keyringPollInterval, bs.SetKeyring, extraKeys...)
+		} else {
+			bs = bridgeserver.NewBridgeServer(wsKeyBytes)
+		}
+		bs.SetRequireHandshake(cfg.RequireHandshake)
+		// tunneled requests are routed by the rules or forwarded to the next exit node when this node is a relay,
+		// they are tracked individually as the websocket connection they arrive on carries many
+		bridgeTracker := requestlogging.NewRequestTrackingWrapper(upstream)
+		bridgeTracker.SetAccessLog(accessLog)
+		bs.SetUpstream(bridgeTracker)
+		trackers = append(trackers, bridgeTracker)
+		rp = bs
 	default:
-		rp = proxy.NewDirectHTTPProxy()
+		rp = upstream
 	}
 
-	if len(cfg.Rules) > 0 {
-		rulesEng := rulesengine.NewRulesEngine(cfg.Rules)
-		rw := rulesengine.NewRequestWrapper(rulesEng)
+	tracker := requestlogging.NewRequestTrackingWrapper(rp)
+	tracker.SetAccessLog(accessLog)
+	trackers = append(trackers, tracker)
+	rp = tracker
 
-		rw.AddProxyProvider(rulesengine.DefaultProviderName, proxy.NewDirectHTTPProxy())
-
-		for _, entry := range rulesEng.GetExitNodes() {
-			wsKeyBytes, err = hex.DecodeString(entry.Key)
+	var authenticator *auth.Authenticator
+	if cfg.Auth.Enabled() {
+		var users map[string][]byte
+		if cfg.Auth.Htpasswd != "" {
+			users, err = auth.LoadHtpasswd(cfg.Auth.Htpasswd)
 			if err != nil {
-				log.Fatal("failed to decode ws-key:", err)
-			}
-
-			if len(wsKeyBytes) != 32 {
-				log.Fatal("ws-key must be 32 bytes long", len(wsKeyBytes))
+				log.Fatal("failed to load htpasswd file:", err)
 			}
-
-			rw.AddProxyProvider(entry.URL, proxy.NewWSBridgeProxyClient(entry.URL, wsKeyBytes))
 		}
-
-		rp = rw
+		authenticator = auth.NewAuthenticator(users, cfg.Auth.Tokens)
 	}
 
-	rp = requestlogging.NewRequestTrackingWrapper(rp)
+	// the authenticated user is attached to the request before it is logged and matched against rules
+	httpProcessor := rp
+	if authenticator != nil {
+		if cfg.Mode == "exit" {
+			slog.Warn("proxy authentication is not applied in exit mode, bridges are authenticated by the ws-key")
+		} else {
+			httpProcessor = auth.NewAuthWrapper(rp, authenticator, cfg.Auth.Realm)
+		}
+	}
 
 	server := &http.Server{
 		Addr: cfg.ListenAddr,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-			rp.ProcessRequest(r, w)
+			httpProcessor.ProcessRequest(r, w)
 		}),
 	}
+	if bs != nil {
+		// runs once the listener is closed so bridges reconnect to another exit node
+		server.RegisterOnShutdown(bs.GoAway)
+	}
+
+	var socksServer *socks5.Server
+	if cfg.Socks.ListenAddr != "" {
+		var credentials socks5.CredentialStore
+		if len(cfg.Socks.Users) > 0 {
+			credentials = socks5.StaticCredentials(cfg.Socks.Users)
+		} else if authenticator != nil {
+			credentials = authenticator
+		}
+		socksServer = socks5.NewServer(rp, credentials)
+	}
+
+	metrics.SetMode(cfg.Mode)
+
+	var adminServer *admin.Server
+	if cfg.Admin.ListenAddr != "" {
+		adminServer = admin.NewServer(cfg.Admin.Token)
+		if err := adminServer.HandleAPI(rt, trackers...); err != nil {
+			slog.Warn("admin API disabled, set admin.token to enable it", "error", err)
+		}
+	}
+
+	var tpServer *transparent.Server
+	if cfg.Transparent.ListenAddr != "" {
+		tpServer = transparent.NewServer(rp, cfg.Transparent.TProxy)
+	}
 
 	var serviceArgs []string
 	if configFileName != "" {
@@ -230,8 +632,13 @@ func main() {
 	}
 
 	prg := &program{
-		server: server,
-		config: cfg,
+		server:      server,
+		socksServer: socksServer,
+		tpServer:    tpServer,
+		adminServer: adminServer,
+		tracker:     tracker,
+		accessLog:   accessLog,
+		config:      cfg,
 	}
 	s, err := service.New(prg, svcConfig)
 	if err != nil {
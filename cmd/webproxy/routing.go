@@ -0,0 +1,238 @@
+package main
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/rhysbryant/proxylink/pkg/config"
+	"github.com/rhysbryant/proxylink/pkg/domainlist"
+	"github.com/rhysbryant/proxylink/pkg/httputils"
+	"github.com/rhysbryant/proxylink/pkg/proxy"
+	"github.com/rhysbryant/proxylink/pkg/rulesengine"
+	"gopkg.in/yaml.v2"
+)
+
+// routing owns the rules and the exit node providers built from the config and rebuilds them on reload.
+// providers whose config did not change are kept so their sessions survive a reload
+type routing struct {
+	configPath string
+	mode       string
+	direct     httputils.RequestProcessor
+	nextHop    httputils.RequestProcessor
+	wrapper    *rulesengine.RequestWrapper
+	lists      *domainlist.Manager
+	geo        rulesengine.GeoIP
+	// refuse exit nodes that do not support the key exchange, a startup setting that is not reloaded
+	requireHandshake bool
+
+	mu        sync.Mutex
+	config    *config.Config
+	providers map[string]*providerEntry
+}
+
+type providerEntry struct {
+	// yaml of the config the provider was built from
+	fingerprint string
+	provider    httputils.RequestProcessor
+}
+
+// newRouting builds the routing for cfg, direct makes requests itself and nextHop is the --next provider or nil.
+// geo is used by rules with country and ASN conditions, its databases are not reloaded
+func newRouting(configPath string, mode string, direct, nextHop httputils.RequestProcessor, geo rulesengine.GeoIP, requireHandshake bool, cfg *config.Config) (*routing, error) {
+	empty, _ := rulesengine.NewRulesEngine(nil, rulesengine.ConnectPolicy{}, nil, geo)
+	rt := &routing{
+		configPath:       configPath,
+		mode:             mode,
+		direct:           direct,
+		nextHop:          nextHop,
+		geo:              geo,
+		requireHandshake: requireHandshake,
+		wrapper:          rulesengine.NewRequestWrapper(empty),
+		providers:        map[string]*providerEntry{},
+	}
+	rt.lists = domainlist.NewManager(rt.listsChanged)
+
+	if err := rt.apply(cfg); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// defaultProvider is used for requests no rule sends to an exit node
+func (rt *routing) defaultProvider(cfg *config.Config) httputils.RequestProcessor {
+	// a bridge sends everything to --next unless rules are configured, in which case unmatched requests go direct.
+	// a relay sends unmatched requests on to the next exit node
+	if rt.nextHop != nil && (rt.mode == "exit" || len(cfg.Rules) == 0) {
+		return rt.nextHop
+	}
+	return rt.direct
+}
+
+// apply builds the rules and providers for cfg and swaps them in, the running routing is kept if cfg is invalid
+func (rt *routing) apply(cfg *config.Config) error {
+	lists, err := rt.lists.Load(cfg.Lists)
+	if err != nil {
+		return err
+	}
+	engine, err := rulesengine.NewRulesEngine(cfg.Rules, cfg.Connect, lists, rt.geo)
+	if err != nil {
+		return err
+	}
+
+	entries := map[string]*providerEntry{}
+	var created []*providerEntry
+	fail := func(err error) error {
+		for _, entry := range created {
+			closeProvider(entry.provider)
+		}
+		return err
+	}
+
+	for _, node := range engine.GetExitNodes() {
+		name := node.ProviderName()
+
+		var group rulesengine.ExitGroup
+		var fingerprint []byte
+		if node.Group != "" {
+			var ok bool
+			if group, ok = cfg.ExitGroups[node.Group]; !ok {
+				return fail(fmt.Errorf("rule references unknown exit group %q", node.Group))
+			}
+			fingerprint, _ = yaml.Marshal(group)
+		} else {
+			fingerprint, _ = yaml.Marshal(node)
+		}
+
+		if existing, ok := rt.providers[name]; ok && existing.fingerprint == string(fingerprint) {
+			entries[name] = existing
+			continue
+		}
+
+		var provider httputils.RequestProcessor
+		if node.Group != "" {
+			provider, err = newExitGroup(node.Group, group, rt.requireHandshake)
+		} else {
+			provider, err = newExitNode(node, "", rt.requireHandshake)
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		entry := &providerEntry{fingerprint: string(fingerprint), provider: provider}
+		created = append(created, entry)
+		entries[name] = entry
+	}
+
+	providers := map[string]httputils.RequestProcessor{rulesengine.DefaultProviderName: rt.defaultProvider(cfg)}
+	for name, entry := range entries {
+		providers[name] = entry.provider
+	}
+	rt.wrapper.Update(engine, providers)
+	rt.lists.Use(lists)
+
+	// requests already using a replaced provider keep it until they finish
+	for name, entry := range rt.providers {
+		if entries[name] != entry {
+			closeProvider(entry.provider)
+		}
+	}
+
+	rt.providers = entries
+	rt.config = cfg
+	return nil
+}
+
+// listsChanged rebuilds the rules when a refresh changed a domain list, the providers are kept
+func (rt *routing) listsChanged() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	engine, err := rulesengine.NewRulesEngine(rt.config.Rules, rt.config.Connect, rt.lists.Lists(), rt.geo)
+	if err != nil {
+		slog.Error("failed to apply refreshed domain lists", "error", err)
+		return
+	}
+	rt.wrapper.Update(engine, rt.wrapper.Providers())
+}
+
+func closeProvider(provider httputils.RequestProcessor) {
+	if closer, ok := provider.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// Reload reads the config file again and applies the rules and exit nodes from it
+func (rt *routing) Reload() error {
+	if rt.configPath == "" {
+		return errors.New("no config file to reload")
+	}
+
+	cfg, err := config.LoadConfig(rt.configPath)
+	if err != nil {
+		slog.Error("rejected configuration reload, keeping the running configuration", "error", err)
+		return err
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	previous := rt.config
+	diff := strings.Join(config.Diff(previous, cfg), "\n")
+	if diff == "" {
+		slog.Info("configuration reload found no changes")
+		return nil
+	}
+
+	if err := rt.apply(cfg); err != nil {
+		slog.Error("rejected configuration reload, keeping the running configuration", "error", err, "diff", diff)
+		return err
+	}
+
+	slog.Info("configuration reloaded", "diff", diff)
+	if changed := config.RestartRequired(previous, cfg); len(changed) > 0 {
+		slog.Warn("some configuration changes only take effect after a restart", "settings", strings.Join(changed, ","))
+	}
+	return nil
+}
+
+// Rules returns the rules requests are currently matched against
+func (rt *routing) Rules() []rulesengine.Rule {
+	return rt.wrapper.RulesEngine().Rules()
+}
+
+// ExitNodes returns the status of the exit nodes behind each provider in use
+func (rt *routing) ExitNodes() map[string][]proxy.ExitNodeStatus {
+	nodes := map[string][]proxy.ExitNodeStatus{}
+	for name, provider := range rt.wrapper.Providers() {
+		if reporter, ok := provider.(interface{ Status() []proxy.ExitNodeStatus }); ok {
+			nodes[name] = reporter.Status()
+		}
+	}
+	return nodes
+}
+
+// Lists returns the domain lists in use with their entry counts
+func (rt *routing) Lists() []domainlist.Status {
+	return rt.lists.Status()
+}
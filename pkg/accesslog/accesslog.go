@@ -0,0 +1,190 @@
+package accesslog
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* The access log.
+
+one line per request, tunnel or UDP association written once it finishes, kept apart from the operational log.
+lines are written in the Common or Combined Log Format understood by most log tools, as JSON, or using a text/template
+executed with the Entry.
+
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatCommon   Format = "common"
+	FormatCombined Format = "combined"
+	FormatJSON     Format = "json"
+	FormatTemplate Format = "template"
+)
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// Entry is a finished request, tunnel or UDP association
+type Entry struct {
+	Time          time.Time     `json:"time"` // when the request started
+	Client        string        `json:"client"`
+	User          string        `json:"user,omitempty"`
+	Kind          string        `json:"kind"` // request, tunnel or udp
+	Method        string        `json:"method"`
+	URL           string        `json:"url"` // host:port for tunnels and UDP associations
+	Proto         string        `json:"proto"`
+	Status        int           `json:"status"`
+	BytesSent     int64         `json:"bytesSent"`     // to the client, the response body for requests
+	BytesReceived int64         `json:"bytesReceived"` // from the client, the request body for requests
+	Duration      time.Duration `json:"-"`
+	Rule          string        `json:"rule,omitempty"`
+	Provider      string        `json:"provider,omitempty"`
+	Referer       string        `json:"referer,omitempty"`
+	UserAgent     string        `json:"userAgent,omitempty"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// RequestLine returns the first line of the request as it appears in the Common Log Format
+func (e Entry) RequestLine() string {
+	if e.Proto == "" {
+		return e.Method + " " + e.URL
+	}
+	return e.Method + " " + e.URL + " " + e.Proto
+}
+
+// DurationMs is the time taken in milliseconds
+func (e Entry) DurationMs() float64 {
+	return float64(e.Duration) / float64(time.Millisecond)
+}
+
+type Logger struct {
+	format Format
+	tmpl   *template.Template
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewLogger returns a logger writing entries to out in format, tmpl is the text/template used by FormatTemplate
+func NewLogger(out io.Writer, format Format, tmpl string) (*Logger, error) {
+	l := &Logger{format: format, out: out}
+
+	switch format {
+	case "":
+		l.format = FormatCombined
+	case FormatCommon, FormatCombined, FormatJSON:
+	case FormatTemplate:
+		if tmpl == "" {
+			return nil, fmt.Errorf("the %s access log format needs a template", format)
+		}
+		var err error
+		if l.tmpl, err = template.New("accesslog").Parse(tmpl); err != nil {
+			return nil, fmt.Errorf("invalid access log template: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	return l, nil
+}
+
+// Log writes entry as a single line
+func (l *Logger) Log(entry Entry) error {
+	var line bytes.Buffer
+	switch l.format {
+	case FormatCommon, FormatCombined:
+		writeCLF(&line, entry, l.format == FormatCombined)
+	case FormatJSON:
+		record := struct {
+			Entry
+			DurationMs float64 `json:"durationMs"`
+		}{entry, entry.DurationMs()}
+		if err := json.NewEncoder(&line).Encode(record); err != nil {
+			return fmt.Errorf("failed to encode access log entry: %w", err)
+		}
+	case FormatTemplate:
+		if err := l.tmpl.Execute(&line, entry); err != nil {
+			return fmt.Errorf("failed to execute access log template: %w", err)
+		}
+	}
+	if line.Len() == 0 || line.Bytes()[line.Len()-1] != '\n' {
+		line.WriteByte('\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.out.Write(line.Bytes())
+	return err
+}
+
+// Close closes the output if it is a file the logger owns such as a RotatingFile
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if closer, ok := l.out.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// writeCLF writes host ident authuser [date] "request" status bytes, followed by "referer" "user-agent" when combined
+func writeCLF(line *bytes.Buffer, e Entry, combined bool) {
+	line.WriteString(dash(e.Client))
+	line.WriteString(" - ")
+	line.WriteString(dash(e.User))
+	line.WriteString(" [")
+	line.WriteString(e.Time.Format(clfTimeFormat))
+	line.WriteString("] ")
+	line.WriteString(strconv.Quote(e.RequestLine()))
+	line.WriteByte(' ')
+	if e.Status > 0 {
+		line.WriteString(strconv.Itoa(e.Status))
+	} else {
+		line.WriteByte('-')
+	}
+	line.WriteByte(' ')
+	if e.BytesSent > 0 {
+		line.WriteString(strconv.FormatInt(e.BytesSent, 10))
+	} else {
+		line.WriteByte('-')
+	}
+
+	if combined {
+		line.WriteByte(' ')
+		line.WriteString(strconv.Quote(dash(e.Referer)))
+		line.WriteByte(' ')
+		line.WriteString(strconv.Quote(dash(e.UserAgent)))
+	}
+}
+
+func dash(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,253 @@
+package accesslog
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotated files are named after the time they were rotated, access.log becomes access-2025-06-01T00-00-00.000.log
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// how long writes continue to the current file after a rotation fails before it is tried again
+const rotateRetryInterval = time.Minute
+
+type RotateOptions struct {
+	MaxSize    int64         // bytes written before the file is rotated, 0 for no limit
+	Every      time.Duration // rotate when a new period starts, 24h rotates at midnight UTC, 0 to disable
+	MaxBackups int           // rotated files kept, 0 keeps them all
+	MaxAge     time.Duration // rotated files older than this are removed, 0 keeps them all
+	Compress   bool          // gzip rotated files
+}
+
+// RotatingFile appends to a file, moving it aside when it grows too large or a new period starts.
+// the file is only rotated when written to, old files are compressed and removed in the background
+type RotatingFile struct {
+	path string
+	opts RotateOptions
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	period time.Time
+	// rotation is not tried again until then after it failed
+	retryRotate time.Time
+
+	// compression and clean up of rotated files, one run at a time
+	millMu sync.Mutex
+	millWg sync.WaitGroup
+}
+
+// NewRotatingFile opens path for appending, creating it if needed
+func NewRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) periodOf(t time.Time) time.Time {
+	if f.opts.Every <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(f.opts.Every)
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	// a file left from before a restart belongs to the period it was last written in
+	f.period = f.periodOf(time.Now())
+	if f.size > 0 {
+		f.period = f.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	tooLarge := f.opts.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.opts.MaxSize
+	newPeriod := f.opts.Every > 0 && !f.periodOf(time.Now()).Equal(f.period)
+	if (tooLarge || newPeriod) && time.Now().After(f.retryRotate) {
+		if err := f.rotate(); err != nil {
+			// entries are still written to the current file rather than lost
+			slog.Error("failed to rotate access log", "error", err)
+			f.retryRotate = time.Now().Add(rotateRetryInterval)
+			if f.file == nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the current file aside and starts a new one, if that fails the current file is kept
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rotate()
+}
+
+func (f *RotatingFile) rotate() error {
+	// the file is closed before it is renamed as open files cannot be renamed on windows
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return f.reopen(fmt.Errorf("failed to close access log: %w", err))
+	}
+
+	ext := filepath.Ext(f.path)
+	backup := strings.TrimSuffix(f.path, ext) + "-" + time.Now().UTC().Format(backupTimeFormat) + ext
+	if err := os.Rename(f.path, backup); err != nil {
+		return f.reopen(fmt.Errorf("failed to rotate access log: %w", err))
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.millWg.Add(1)
+	go func() {
+		defer f.millWg.Done()
+		f.mill(backup)
+	}()
+	return nil
+}
+
+// reopen goes back to appending to the current file after rotating it failed
+func (f *RotatingFile) reopen(err error) error {
+	if openErr := f.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// mill compresses the file just rotated and removes the backups no longer kept
+func (f *RotatingFile) mill(backup string) {
+	f.millMu.Lock()
+	defer f.millMu.Unlock()
+
+	if f.opts.Compress {
+		if err := compressFile(backup); err != nil {
+			slog.Error("failed to compress rotated access log", "file", backup, "error", err)
+		}
+	}
+
+	if f.opts.MaxBackups <= 0 && f.opts.MaxAge <= 0 {
+		return
+	}
+
+	ext := filepath.Ext(f.path)
+	backups, err := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext + "*")
+	if err != nil {
+		return
+	}
+	// the names sort by the time they were rotated, newest first
+	slices.Sort(backups)
+	slices.Reverse(backups)
+
+	cutoff := time.Now().Add(-f.opts.MaxAge)
+	for i, name := range backups {
+		remove := f.opts.MaxBackups > 0 && i >= f.opts.MaxBackups
+		if !remove && f.opts.MaxAge > 0 {
+			if info, err := os.Stat(name); err == nil && info.ModTime().Before(cutoff) {
+				remove = true
+			}
+		}
+		if remove {
+			if err := os.Remove(name); err != nil {
+				slog.Error("failed to remove rotated access log", "file", name, "error", err)
+			}
+		}
+	}
+}
+
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	src.Close()
+	return os.Remove(name)
+}
+
+// Close closes the file and waits for rotated files to be compressed
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mu.Unlock()
+
+	f.millWg.Wait()
+	return err
+}
@@ -0,0 +1,161 @@
+package accesslog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLines writes each line, waiting between them so rotated files get distinct names
+func writeLines(t *testing.T, f *RotatingFile, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if _, err := f.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func backups(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "access-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotateOnSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := NewRotatingFile(path, RotateOptions{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeLines(t, f, "first", "second")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, path); got != "second\n" {
+		t.Errorf("current file has %q", got)
+	}
+	rotated := backups(t, dir)
+	if len(rotated) != 1 {
+		t.Fatalf("got rotated files %q", rotated)
+	}
+	if !strings.HasSuffix(rotated[0], ".log") {
+		t.Errorf("rotated file %q lost its extension", rotated[0])
+	}
+	if got := readFile(t, rotated[0]); got != "first\n" {
+		t.Errorf("rotated file has %q", got)
+	}
+}
+
+func TestRotateMaxBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := NewRotatingFile(path, RotateOptions{MaxSize: 5, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeLines(t, f, "one", "two", "three", "four", "five")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := backups(t, dir)
+	if len(rotated) != 2 {
+		t.Fatalf("got rotated files %q", rotated)
+	}
+	// the newest are kept
+	if got := readFile(t, rotated[0]) + readFile(t, rotated[1]); got != "three\nfour\n" {
+		t.Errorf("kept %q", got)
+	}
+}
+
+func TestRotateCompress(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := NewRotatingFile(path, RotateOptions{MaxSize: 10, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeLines(t, f, "first", "second")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := backups(t, dir)
+	if len(rotated) != 1 || !strings.HasSuffix(rotated[0], ".log.gz") {
+		t.Fatalf("got rotated files %q", rotated)
+	}
+	file, err := os.Open(rotated[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first\n" {
+		t.Errorf("compressed file has %q", data)
+	}
+}
+
+func TestRotateFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := NewRotatingFile(path, RotateOptions{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	writeLines(t, f, "first")
+	// renaming a file that is no longer there fails
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	// the write goes to the reopened file rather than failing
+	writeLines(t, f, "second")
+	if got := readFile(t, path); got != "second\n" {
+		t.Errorf("current file has %q", got)
+	}
+	if rotated := backups(t, dir); len(rotated) != 0 {
+		t.Errorf("got rotated files %q", rotated)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Rotate(); err == nil {
+		t.Error("rotating a removed file succeeded")
+	}
+	writeLines(t, f, "third")
+	if got := readFile(t, path); got != "third\n" {
+		t.Errorf("current file has %q", got)
+	}
+}
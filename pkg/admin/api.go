@@ -0,0 +1,193 @@
+package admin
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/rhysbryant/proxylink/pkg/domainlist"
+	"github.com/rhysbryant/proxylink/pkg/proxy"
+	"github.com/rhysbryant/proxylink/pkg/requestlogging"
+	"github.com/rhysbryant/proxylink/pkg/rulesengine"
+)
+
+// ConnectionTracker lists and ends the connections in progress, see requestlogging.RequestTrackingWrapper
+type ConnectionTracker interface {
+	Connections() []requestlogging.ConnectionInfo
+	Kill(id uint64) bool
+}
+
+// Routing exposes the rules and exit nodes in use and reloads them from the config file
+type Routing interface {
+	Rules() []rulesengine.Rule
+	// ExitNodes returns the status of the nodes behind each provider by provider name
+	ExitNodes() map[string][]proxy.ExitNodeStatus
+	Lists() []domainlist.Status
+	Reload() error
+}
+
+// ruleView is a rule as returned by the API, exit nodes are shown by provider name so their keys are not exposed
+type ruleView struct {
+	Name          string                     `json:"name"`
+	Block         bool                       `json:"block,omitempty"`
+	Target        []string                   `json:"target,omitempty"`
+	Match         rulesengine.MatchType      `json:"match,omitempty"`
+	Lists         []string                   `json:"lists,omitempty"`
+	TargetPort    string                     `json:"targetPort,omitempty"`
+	Source        []string                   `json:"source,omitempty"`
+	DestinationIP []string                   `json:"destinationIP,omitempty"`
+	Country       []string                   `json:"country,omitempty"`
+	ASN           []uint32                   `json:"asn,omitempty"`
+	SourceCountry []string                   `json:"sourceCountry,omitempty"`
+	Users         []string                   `json:"users,omitempty"`
+	Method        []string                   `json:"method,omitempty"`
+	Path          []string                   `json:"path,omitempty"`
+	PathRegex     string                     `json:"pathRegex,omitempty"`
+	Query         map[string]string          `json:"query,omitempty"`
+	Headers       map[string]string          `json:"headers,omitempty"`
+	Provider      string                     `json:"provider"`
+	Connect       *rulesengine.ConnectPolicy `json:"connect,omitempty"`
+	Intercept     *bool                      `json:"intercept,omitempty"`
+	Schedule      *rulesengine.Schedule      `json:"schedule,omitempty"`
+}
+
+type api struct {
+	routing  Routing
+	trackers []ConnectionTracker
+}
+
+// ErrNoToken is returned by HandleAPI when the server has no token
+var ErrNoToken = errors.New("the admin API needs a token")
+
+// HandleAPI registers the JSON endpoints under /api for inspecting and closing connections, viewing the rules,
+// exit node health and domain lists and reloading the config. trackers are searched in order, connection ids are unique across them.
+// the API can close connections and reload the config so it is only registered when the server has a token
+func (s *Server) HandleAPI(routing Routing, trackers ...ConnectionTracker) error {
+	if s.token == "" {
+		return ErrNoToken
+	}
+
+	a := &api{routing: routing, trackers: trackers}
+	s.mux.HandleFunc("GET /api/connections", a.listConnections)
+	s.mux.HandleFunc("DELETE /api/connections/{id}", a.killConnection)
+	s.mux.HandleFunc("GET /api/rules", a.listRules)
+	s.mux.HandleFunc("GET /api/exit-nodes", a.listExitNodes)
+	s.mux.HandleFunc("GET /api/lists", a.listLists)
+	s.mux.HandleFunc("POST /api/reload", a.reload)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("failed to write admin API response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func (a *api) listConnections(w http.ResponseWriter, r *http.Request) {
+	connections := []requestlogging.ConnectionInfo{}
+	for _, tracker := range a.trackers {
+		connections = append(connections, tracker.Connections()...)
+	}
+	slices.SortFunc(connections, func(a, b requestlogging.ConnectionInfo) int { return cmp.Compare(a.ID, b.ID) })
+
+	// optional filters, ?kind=tunnel&user=alice
+	query := r.URL.Query()
+	connections = slices.DeleteFunc(connections, func(c requestlogging.ConnectionInfo) bool {
+		return (query.Has("kind") && c.Kind != query.Get("kind")) || (query.Has("user") && c.User != query.Get("user"))
+	})
+	writeJSON(w, http.StatusOK, connections)
+}
+
+func (a *api) killConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid connection id")
+		return
+	}
+
+	for _, tracker := range a.trackers {
+		if tracker.Kill(id) {
+			slog.Info("connection closed by admin API", "id", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "connection not found")
+}
+
+func (a *api) listRules(w http.ResponseWriter, r *http.Request) {
+	rules := a.routing.Rules()
+	views := make([]ruleView, len(rules))
+	for i, rule := range rules {
+		views[i] = ruleView{
+			Name:          rule.Name,
+			Block:         rule.Block,
+			Target:        rule.Target,
+			Match:         rule.Match,
+			Lists:         rule.Lists,
+			TargetPort:    rule.TargetPort,
+			Source:        rule.Source,
+			DestinationIP: rule.DestinationIP,
+			Country:       rule.Country,
+			ASN:           rule.ASN,
+			SourceCountry: rule.SourceCountry,
+			Users:         rule.Users,
+			Method:        rule.Method,
+			Path:          rule.Path,
+			PathRegex:     rule.PathRegex,
+			Query:         rule.Query,
+			Headers:       rule.Headers,
+			Provider:      rulesengine.DefaultProviderName,
+			Connect:       rule.Connect,
+			Intercept:     rule.Intercept,
+			Schedule:      rule.Schedule,
+		}
+		if rule.Exit != nil {
+			views[i].Provider = rule.Exit.ProviderName()
+		}
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *api) listExitNodes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.routing.ExitNodes())
+}
+
+func (a *api) listLists(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.routing.Lists())
+}
+
+func (a *api) reload(w http.ResponseWriter, r *http.Request) {
+	if err := a.routing.Reload(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
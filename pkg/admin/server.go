@@ -0,0 +1,94 @@
+package admin
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* The admin listener.
+
+serves operational endpoints such as /metrics on an address separate from the proxy listener
+so they are never reachable through the proxy itself. when a token is set every request must
+carry it as a bearer token.
+
+*/
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rhysbryant/proxylink/pkg/metrics"
+)
+
+type Server struct {
+	token string
+	mux   *http.ServeMux
+
+	mu     sync.Mutex
+	server *http.Server
+}
+
+// NewServer returns an admin server serving /metrics, an empty token leaves /metrics unauthenticated and the API disabled
+func NewServer(token string) *Server {
+	s := &Server{token: token, mux: http.NewServeMux()}
+	s.mux.Handle("/metrics", metrics.Handler())
+	return s
+}
+
+// Handle registers an additional admin endpoint
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" && !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="proxylink admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// ListenAndServe serves the admin endpoints on addr until Close is called
+func (s *Server) ListenAndServe(addr string) error {
+	s.mu.Lock()
+	s.server = &http.Server{Addr: addr, Handler: s}
+	server := s.server
+	s.mu.Unlock()
+
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
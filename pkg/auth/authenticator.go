@@ -0,0 +1,150 @@
+package auth
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt is deliberately slow and clients send credentials with every request,
+// successful checks are remembered for this long
+const verifiedCacheTTL = 5 * time.Minute
+
+// Token is a static bearer token and the user it authenticates as
+type Token struct {
+	User  string `yaml:"user"`
+	Token string `yaml:"token"`
+}
+
+// Authenticator checks proxy credentials against an htpasswd file and static bearer tokens
+type Authenticator struct {
+	htpasswd map[string][]byte
+	tokens   []Token
+
+	verified sync.Map // sha256 of user and password -> expiry time
+}
+
+func NewAuthenticator(htpasswd map[string][]byte, tokens []Token) *Authenticator {
+	return &Authenticator{htpasswd: htpasswd, tokens: tokens}
+}
+
+// LoadHtpasswd reads an htpasswd file of user:hash lines, only bcrypt hashes are supported
+func LoadHtpasswd(filePath string) (map[string][]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open htpasswd file: %w", err)
+	}
+	defer file.Close()
+
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("htpasswd line %d: missing ':'", lineNumber)
+		}
+
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
+			return nil, fmt.Errorf("htpasswd line %d: only bcrypt hashes are supported (htpasswd -B)", lineNumber)
+		}
+
+		users[user] = []byte(hash)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+
+	return users, nil
+}
+
+// Valid checks a username and password, the password may also be a bearer token issued to that user
+func (a *Authenticator) Valid(username, password string) bool {
+	if user, ok := a.validToken(password); ok && user == username {
+		return true
+	}
+
+	hash, ok := a.htpasswd[username]
+	if !ok {
+		return false
+	}
+
+	cacheKey := sha256.Sum256([]byte(username + "\x00" + password))
+	if expiry, ok := a.verified.Load(cacheKey); ok && time.Now().Before(expiry.(time.Time)) {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	a.verified.Store(cacheKey, time.Now().Add(verifiedCacheTTL))
+	return true
+}
+
+func (a *Authenticator) validToken(token string) (string, bool) {
+	for _, t := range a.tokens {
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return t.User, true
+		}
+	}
+	return "", false
+}
+
+// Authenticate checks the Proxy-Authorization header and returns the authenticated username
+func (a *Authenticator) Authenticate(r *http.Request) (string, bool) {
+	scheme, credentials, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok {
+		return "", false
+	}
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+		if err != nil {
+			return "", false
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok || !a.Valid(username, password) {
+			return "", false
+		}
+		return username, true
+	case "bearer":
+		return a.validToken(strings.TrimSpace(credentials))
+	}
+
+	return "", false
+}
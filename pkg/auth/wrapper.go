@@ -0,0 +1,61 @@
+package auth
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/rhysbryant/proxylink/pkg/httputils"
+)
+
+const DefaultRealm = "proxylink"
+
+// AuthWrapper requires Proxy-Authorization on every request before passing it on,
+// the authenticated username is attached to the request with httputils.WithUser
+type AuthWrapper struct {
+	next          httputils.RequestProcessor
+	authenticator *Authenticator
+	realm         string
+}
+
+func NewAuthWrapper(next httputils.RequestProcessor, authenticator *Authenticator, realm string) *AuthWrapper {
+	if realm == "" {
+		realm = DefaultRealm
+	}
+	return &AuthWrapper{next: next, authenticator: authenticator, realm: realm}
+}
+
+func (aw *AuthWrapper) ProcessRequest(r *http.Request, w http.ResponseWriter) error {
+	user, ok := aw.authenticator.Authenticate(r)
+	if !ok {
+		slog.Info("proxy authentication failed", "from", r.RemoteAddr,
+			"destination", r.URL.Host, "credentialsSent", r.Header.Get("Proxy-Authorization") != "")
+
+		w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", aw.realm))
+		w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Bearer realm=%q", aw.realm))
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return fmt.Errorf("proxy authentication required")
+	}
+
+	// the credentials are for this proxy only and must not reach the next hop
+	r.Header.Del("Proxy-Authorization")
+
+	return aw.next.ProcessRequest(httputils.WithUser(r, user), w)
+}
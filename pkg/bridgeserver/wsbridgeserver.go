@@ -19,29 +19,122 @@ package bridgeserver
 
 import (
 	"bufio"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 
 	"github.com/gorilla/websocket"
 	"github.com/rhysbryant/proxylink/pkg/httputils"
+	"github.com/rhysbryant/proxylink/pkg/ioutils"
+	"github.com/rhysbryant/proxylink/pkg/keyring"
+	"github.com/rhysbryant/proxylink/pkg/mux"
 	"github.com/rhysbryant/proxylink/pkg/proxy"
+	"github.com/rhysbryant/proxylink/pkg/udprelay"
 	"github.com/rhysbryant/proxylink/pkg/wswrapper"
 )
 
 type BridgeServer struct {
-	key []byte
+	keyring          atomic.Pointer[keyring.Keyring]
+	requireHandshake bool
+	upstream         httputils.RequestProcessor
+
+	// open connections by the name of the key they authenticated with, so revoked keys can be disconnected
+	activeMu sync.Mutex
+	active   map[string]map[*activeConn]struct{}
+}
+
+type activeConn struct {
+	key  []byte
+	conn io.Closer
+	// set for bridges that understand the go away frame
+	session *mux.Session
 }
 
+// NewBridgeServer returns a server accepting a single shared key, a nil key disables encryption
 func NewBridgeServer(key []byte) *BridgeServer {
-	return &BridgeServer{key: key}
+	var kr *keyring.Keyring
+	if key != nil {
+		kr, _ = keyring.NewKeyring([]keyring.Key{{Name: keyring.DefaultKeyName, Key: hex.EncodeToString(key)}})
+	}
+	return NewBridgeServerWithKeyring(kr)
+}
+
+// NewBridgeServerWithKeyring returns a server accepting any key in kr
+func NewBridgeServerWithKeyring(kr *keyring.Keyring) *BridgeServer {
+	bs := &BridgeServer{active: map[string]map[*activeConn]struct{}{}, upstream: proxy.NewDirectHTTPProxy()}
+	bs.keyring.Store(kr)
+	return bs
+}
+
+// SetKeyring replaces the accepted keys, connections using a key that is no longer in kr are closed
+func (bs *BridgeServer) SetKeyring(kr *keyring.Keyring) {
+	bs.keyring.Store(kr)
+
+	bs.activeMu.Lock()
+	defer bs.activeMu.Unlock()
+	for name, conns := range bs.active {
+		for ac := range conns {
+			if !kr.Contains(name, ac.key) {
+				slog.Info("closing connection for revoked key", "client", name)
+				ac.conn.Close()
+			}
+		}
+	}
+}
+
+// SetRequireHandshake refuses bridges that only support encrypting with the pre-shared key directly,
+// the key exchange gives every connection its own key so recorded traffic stays private if the pre-shared key leaks
+func (bs *BridgeServer) SetRequireHandshake(required bool) {
+	bs.requireHandshake = required
+}
+
+// SetUpstream sets where tunneled requests are sent, by default they are made directly.
+// a WSBridgeProxyClient here forwards requests on to another exit node, making this node a relay
+func (bs *BridgeServer) SetUpstream(upstream httputils.RequestProcessor) {
+	bs.upstream = upstream
+}
+
+// GoAway asks connected bridges to stop sending new requests on their sessions so they reconnect elsewhere,
+// requests in progress carry on. bridges that do not understand it are left until their connections close
+func (bs *BridgeServer) GoAway() {
+	bs.activeMu.Lock()
+	defer bs.activeMu.Unlock()
+	for _, conns := range bs.active {
+		for ac := range conns {
+			if ac.session != nil {
+				ac.session.GoAway()
+			}
+		}
+	}
+}
+
+func (bs *BridgeServer) track(name string, ac *activeConn) func() {
+	bs.activeMu.Lock()
+	defer bs.activeMu.Unlock()
+	if bs.active[name] == nil {
+		bs.active[name] = map[*activeConn]struct{}{}
+	}
+	bs.active[name][ac] = struct{}{}
+
+	return func() {
+		bs.activeMu.Lock()
+		defer bs.activeMu.Unlock()
+		delete(bs.active[name], ac)
+		if len(bs.active[name]) == 0 {
+			delete(bs.active, name)
+		}
+	}
 }
 
 func (bs *BridgeServer) isAllowed(remoteAddr string) bool {
 	//only allow external connections if a key is set
-	if bs.key != nil {
+	if bs.keyring.Load().Len() > 0 {
 		return true
 	}
 
@@ -54,6 +147,27 @@ func (bs *BridgeServer) isAllowed(remoteAddr string) bool {
 	return parsedIPAddr.IsPrivate()
 }
 
+// selectKey picks the key for the connecting bridge, an empty name and nil key means encryption is disabled
+func (bs *BridgeServer) selectKey(r *http.Request) (name string, key []byte, err error) {
+	kr := bs.keyring.Load()
+	if kr.Len() == 0 {
+		return "", nil, nil
+	}
+
+	if fingerprint := r.Header.Get(wswrapper.KeyIDHeader); fingerprint != "" {
+		if name, key, ok := kr.Lookup(fingerprint); ok {
+			return name, key, nil
+		}
+		return "", nil, fmt.Errorf("unknown or revoked key %s", fingerprint)
+	}
+
+	// bridges from before keyrings were supported do not identify their key
+	if name, key, ok := kr.Default(); ok {
+		return name, key, nil
+	}
+	return "", nil, errors.New("bridge did not identify its key")
+}
+
 func (bs *BridgeServer) ProcessRequest(r *http.Request, w http.ResponseWriter) error {
 
 	if !bs.isAllowed(r.RemoteAddr) {
@@ -61,34 +175,136 @@ func (bs *BridgeServer) ProcessRequest(r *http.Request, w http.ResponseWriter) e
 		return fmt.Errorf("connection from %s not allowed", r.RemoteAddr)
 	}
 
-	upgrader := websocket.Upgrader{}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	client, key, err := bs.selectKey(r)
+	if err != nil {
+		http.Error(w, "not allowed", http.StatusForbidden)
+		return fmt.Errorf("connection from %s not allowed: %w", r.RemoteAddr, err)
+	}
+
+	handshake := key != nil && r.Header.Get(wswrapper.HandshakeHeader) == wswrapper.HandshakeX25519PSK
+	if key != nil && !handshake && bs.requireHandshake {
+		http.Error(w, "key exchange required", http.StatusForbidden)
+		return fmt.Errorf("connection from %s not allowed: bridge does not support the key exchange", r.RemoteAddr)
+	}
+
+	responseHeader := http.Header{}
+	if handshake {
+		responseHeader.Set(wswrapper.HandshakeHeader, wswrapper.HandshakeX25519PSK)
+	}
+
+	upgrader := websocket.Upgrader{Subprotocols: mux.Protocols}
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		return err
 	}
 
 	var rw io.ReadWriteCloser
-	if bs.key != nil {
-		rw = wswrapper.NewWSConnWithEncryption(conn, [32]byte(bs.key), false)
-	} else {
+	switch {
+	case handshake:
+		rw, err = wswrapper.NewWSConnWithHandshake(conn, [32]byte(key), false)
+		if err != nil {
+			return fmt.Errorf("handshake with bridge %s failed: %w", r.RemoteAddr, err)
+		}
+	case key != nil:
+		slog.Warn("bridge does not support the key exchange, falling back to the pre-shared key", "remoteAddr", r.RemoteAddr, "client", client)
+		rw = wswrapper.NewWSConnWithEncryption(conn, [32]byte(key), false)
+	default:
 		rw = wswrapper.NewWSConn(conn)
 	}
+
+	ac := &activeConn{key: key, conn: rw}
+
+	// bridges that negotiated multiplexing send many requests over this connection
+	var session *mux.Session
+	if mux.IsProtocol(conn.Subprotocol()) {
+		session = mux.NewServerSession(rw)
+		if conn.Subprotocol() == mux.ProtocolV2 {
+			ac.session = session
+		}
+	}
+
+	defer bs.track(client, ac)()
+
+	if client != "" {
+		slog.Info("bridge connected", "client", client, "from", r.RemoteAddr)
+	}
+
+	if session != nil {
+		return bs.serveSession(session, r.RemoteAddr, client)
+	}
+
 	defer rw.Close()
+	return bs.serveStream(rw, r.RemoteAddr, client)
+}
+
+// serveSession accepts streams until the bridge closes the session, each stream carries one request
+func (bs *BridgeServer) serveSession(session *mux.Session, remoteAddr string, client string) error {
+	defer session.Close()
 
+	slog.Debug("bridge session started", "from", remoteAddr, "client", client)
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			slog.Debug("bridge session ended", "from", remoteAddr, "client", client, "reason", session.Err())
+			return nil
+		}
+
+		go func() {
+			defer stream.Close()
+			if err := bs.serveStream(stream, remoteAddr, client); err != nil {
+				slog.Info("tunneled request error", "error", err, "from", remoteAddr, "client", client)
+			}
+		}()
+	}
+}
+
+// serveStream handles a single tunneled request, client is the name of the key the bridge authenticated with
+func (bs *BridgeServer) serveStream(rw io.ReadWriteCloser, remoteAddr string, client string) error {
 	// first will come a http request from the client
-	proxiedRequest, err := http.ReadRequest(bufio.NewReader(rw))
+	reader := bufio.NewReader(rw)
+	proxiedRequest, err := http.ReadRequest(reader)
 	if err != nil {
 		return fmt.Errorf("failed to read request from websocket: %w", err)
 	}
+	rw = ioutils.NewBufferedReadWriteCloser(rw, reader)
+	// rules on the exit node match the source against the bridge
+	proxiedRequest.RemoteAddr = remoteAddr
+
+	if proxiedRequest.Method == udprelay.MethodAssociate {
+		// the destination of an association is only carried in the Host header
+		proxiedRequest.URL.Host = proxiedRequest.Host
+	}
 
 	logEntryContext := slog.With("target", proxiedRequest.URL.String(),
-		"method", proxiedRequest.Method, "from", r.RemoteAddr)
+		"method", proxiedRequest.Method, "from", remoteAddr, "client", client)
 
 	logEntryContext.Info("Processing tunneled request")
 
-	if proxiedRequest.Method == http.MethodConnect {
-		return proxy.NewDirectHTTPProxy().ProcessTunnelRequest(proxiedRequest, rw)
+	if proxiedRequest.Method == udprelay.MethodAssociate {
+		return bs.serveAssociate(proxiedRequest, rw)
+	}
+
+	return bs.upstream.ProcessRequest(proxiedRequest, httputils.NewResponseWriter(rw))
+}
+
+// serveAssociate relays datagrams framed on the stream through the upstream
+func (bs *BridgeServer) serveAssociate(r *http.Request, rw io.ReadWriteCloser) error {
+	w := httputils.NewResponseWriter(rw)
+
+	dialer, ok := bs.upstream.(udprelay.Dialer)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return errors.New("udp relay not supported by the upstream")
 	}
 
-	return proxy.NewDirectHTTPProxy().ProcessRequest(proxiedRequest, httputils.NewResponseWriter(rw))
+	conn, err := dialer.DialPacket(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return fmt.Errorf("failed to open udp association: %w", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	return udprelay.Pipe(udprelay.NewStreamConn(rw), conn)
 }
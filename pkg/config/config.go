@@ -3,17 +3,40 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/rhysbryant/proxylink/pkg/auth"
+	"github.com/rhysbryant/proxylink/pkg/domainlist"
+	"github.com/rhysbryant/proxylink/pkg/proxy"
 	"github.com/rhysbryant/proxylink/pkg/rulesengine"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	ListenAddr string             `yaml:"listen"` // Address to listen on
-	Mode       string             `yaml:"mode"`   // standalone, bridge, exit
-	TLS        TLSConfig          `yaml:"tls"`    // TLS configuration
-	Rules      []rulesengine.Rule `yaml:"rules"`  // Proxy rules
-	Key        string             `yaml:"wsKey"`  // 32-byte key for encrypting WebSocket traffic (optional)
+	ListenAddr           string                           `yaml:"listen"`               // Address to listen on
+	Mode                 string                           `yaml:"mode"`                 // standalone, bridge, exit
+	TLS                  TLSConfig                        `yaml:"tls"`                  // TLS configuration
+	Connect              rulesengine.ConnectPolicy        `yaml:"connect"`              // Ports and protocols CONNECT tunnels may use
+	Rules                []rulesengine.Rule               `yaml:"rules"`                // Proxy rules
+	ExitGroups           map[string]rulesengine.ExitGroup `yaml:"exitGroups"`           // Named groups of exit nodes rules can reference
+	Key                  string                           `yaml:"wsKey"`                // 32-byte key for encrypting WebSocket traffic (optional)
+	Keyring              string                           `yaml:"keyring"`              // Path to a file of named client keys (exit mode)
+	NextKey              string                           `yaml:"nextKey"`              // 32-byte key for the hop to the next exit node when relaying (exit mode)
+	RequireHandshake     bool                             `yaml:"requireHandshake"`     // Refuse bridges without forward secret key exchange (exit mode)
+	RequireExitHandshake *bool                            `yaml:"requireExitHandshake"` // Refuse exit nodes without forward secret key exchange, defaults to true (bridge mode and relays)
+	Socks                SocksConfig                      `yaml:"socks"`                // SOCKS5 listener configuration
+	Transparent          TransparentConfig                `yaml:"transparent"`          // Transparent proxy listener configuration (linux only)
+	WatchConfig          bool                             `yaml:"watchConfig"`          // Reload rules and exit nodes when this file changes
+	ShutdownTimeout      time.Duration                    `yaml:"shutdownTimeout"`      // How long connections may take to finish when stopping
+	Admin                AdminConfig                      `yaml:"admin"`                // Admin listener for metrics
+	Auth                 AuthConfig                       `yaml:"auth"`                 // Proxy authentication for clients (standalone and bridge modes)
+	DestinationPolicy    DestinationPolicyConfig          `yaml:"destinationPolicy"`    // Addresses direct connections may not be made to
+	AccessLog            AccessLogConfig                  `yaml:"accessLog"`            // Access log kept apart from the operational log
+	Upstream             proxy.TransportOptions           `yaml:"upstream"`             // Timeouts and pooling of direct connections to destinations
+	Forwarding           ForwardingConfig                 `yaml:"forwarding"`           // Via and X-Forwarded-For headers of plain requests
+	Intercept            InterceptConfig                  `yaml:"intercept"`            // Decrypting tunnels with a local CA
+	Lists                map[string]domainlist.Source     `yaml:"lists"`                // External domain lists rules can reference by name
+	GeoIP                GeoIPConfig                      `yaml:"geoip"`                // Local MaxMind databases for country and ASN rule conditions
 }
 
 type TLSConfig struct {
@@ -23,6 +46,104 @@ type TLSConfig struct {
 	Domain      string `yaml:"domain"`      // Domain name for Let's Encrypt
 }
 
+type SocksConfig struct {
+	ListenAddr string            `yaml:"listen"` // Address for the SOCKS5 listener, disabled if empty
+	Users      map[string]string `yaml:"users"`  // Username to password, authentication is required if set
+}
+
+type AdminConfig struct {
+	ListenAddr string `yaml:"listen"` // Address for the admin listener, disabled if empty
+	Token      string `yaml:"token"`  // Bearer token required by admin endpoints (optional)
+}
+
+type AccessLogConfig struct {
+	File        string        `yaml:"file"`        // Path of the access log, - for stdout, disabled if empty
+	Format      string        `yaml:"format"`      // common, combined (default), json or template
+	Template    string        `yaml:"template"`    // text/template executed with each entry when the format is template
+	MaxSize     int64         `yaml:"maxSize"`     // Megabytes written before the file is rotated, 0 for no limit
+	RotateEvery time.Duration `yaml:"rotateEvery"` // Rotate when a period this long starts, 24h rotates at midnight UTC
+	MaxBackups  int           `yaml:"maxBackups"`  // Rotated files kept, 0 keeps them all
+	MaxAge      time.Duration `yaml:"maxAge"`      // Rotated files older than this are removed, 0 keeps them all
+	Compress    bool          `yaml:"compress"`    // Gzip rotated files
+}
+
+type TransparentConfig struct {
+	ListenAddr string `yaml:"listen"` // Address for the transparent listener, disabled if empty
+	TProxy     bool   `yaml:"tproxy"` // Traffic is delivered with TPROXY instead of REDIRECT
+}
+
+type AuthConfig struct {
+	Htpasswd string       `yaml:"htpasswd"` // Path to an htpasswd file with bcrypt hashes
+	Tokens   []auth.Token `yaml:"tokens"`   // Static bearer tokens
+	Realm    string       `yaml:"realm"`    // Realm sent in the authentication challenge
+}
+
+// Enabled reports if any credentials are configured
+func (a AuthConfig) Enabled() bool {
+	return a.Htpasswd != "" || len(a.Tokens) > 0
+}
+
+type DestinationPolicyConfig struct {
+	Enabled   *bool    `yaml:"enabled"`   // Defaults to enabled in exit mode only
+	Deny      []string `yaml:"deny"`      // CIDR ranges denied as well as the loopback, private and link local ranges
+	Allow     []string `yaml:"allow"`     // CIDR ranges allowed even though they are denied
+	DenyPorts []uint16 `yaml:"denyPorts"` // Destination ports denied on every address
+}
+
+// ExitHandshakeRequired reports if exit nodes must support the key exchange, it is required unless turned off
+func (c *Config) ExitHandshakeRequired() bool {
+	return c.RequireExitHandshake == nil || *c.RequireExitHandshake
+}
+
+// IsEnabled reports if the policy applies in mode, exit nodes use it unless it is turned off
+// as anyone with the key could otherwise reach services on the exit node's network
+func (d DestinationPolicyConfig) IsEnabled(mode string) bool {
+	if d.Enabled != nil {
+		return *d.Enabled
+	}
+	return mode == "exit"
+}
+
+type InterceptConfig struct {
+	Enabled   bool   `yaml:"enabled"`   // Intercept tunnels unless the rule they match sets intercept: false
+	CACert    string `yaml:"caCert"`    // PEM certificate of the CA leaf certificates are signed with, clients must trust it
+	CAKey     string `yaml:"caKey"`     // PEM private key of the CA
+	CacheSize int    `yaml:"cacheSize"` // Leaf certificates kept, 1000 if not set
+}
+
+type GeoIPConfig struct {
+	CountryDB string `yaml:"countryDB"` // Path of a Country or City .mmdb file, needed by country and sourceCountry conditions
+	ASNDB     string `yaml:"asnDB"`     // Path of an ASN .mmdb file, needed by asn conditions
+}
+
+type ForwardingConfig struct {
+	Via          string `yaml:"via"`          // on, off or anonymise, anonymise in exit mode and off otherwise by default
+	ForwardedFor string `yaml:"forwardedFor"` // on, off or anonymise for X-Forwarded-For and Forwarded, defaults as for via
+	Pseudonym    string `yaml:"pseudonym"`    // Name added to Via, proxylink if empty
+}
+
+// Policy returns the forwarding policy for mode, exit nodes remove the headers unless configured otherwise
+// so nothing about the bridge side reaches destinations
+func (f ForwardingConfig) Policy(mode string) proxy.ForwardingPolicy {
+	defaultMode := proxy.ForwardingOff
+	if mode == "exit" {
+		defaultMode = proxy.ForwardingAnonymise
+	}
+
+	policy := proxy.ForwardingPolicy{
+		Via:          proxy.ForwardingMode(f.Via),
+		ForwardedFor: proxy.ForwardingMode(f.ForwardedFor),
+		Pseudonym:    f.Pseudonym,
+	}
+	if policy.Via == "" {
+		policy.Via = defaultMode
+	}
+	if policy.ForwardedFor == "" {
+		policy.ForwardedFor = defaultMode
+	}
+	return policy
+}
+
 func LoadConfig(filePath string) (*Config, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
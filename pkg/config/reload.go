@@ -0,0 +1,197 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rhysbryant/proxylink/pkg/domainlist"
+	"github.com/rhysbryant/proxylink/pkg/filewatch"
+	"github.com/rhysbryant/proxylink/pkg/rulesengine"
+	"gopkg.in/yaml.v2"
+)
+
+// redactKey keys the hashes of redacted values, it is random for every run so the hash of a weak password
+// cannot be looked up or brute forced from the log
+var redactKey = rand.Text()
+
+// Diff returns the lines that differ between the yaml forms of old and new, prefixed with - or +.
+// secret values are replaced by a short hash so a changed key is visible without being logged
+func Diff(old, new *Config) []string {
+	return diffLines(redactedLines(old), redactedLines(new))
+}
+
+// RestartRequired returns the top level settings that changed and only take effect after a restart
+func RestartRequired(old, new *Config) []string {
+	oldSections := sections(old)
+	newSections := sections(new)
+
+	var changed []string
+	for name, value := range newSections {
+		if oldSections[name] != value {
+			changed = append(changed, name)
+		}
+	}
+	for name := range oldSections {
+		if _, ok := newSections[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// reloadable settings are applied without a restart
+var reloadable = map[string]bool{"rules": true, "exitGroups": true, "connect": true, "lists": true}
+
+func sections(cfg *Config) map[string]string {
+	data, _ := yaml.Marshal(cfg)
+	var top yaml.MapSlice
+	yaml.Unmarshal(data, &top)
+
+	result := map[string]string{}
+	for _, item := range top {
+		name, _ := item.Key.(string)
+		if reloadable[name] {
+			continue
+		}
+		value, _ := yaml.Marshal(item.Value)
+		result[name] = string(value)
+	}
+	return result
+}
+
+func redactedLines(cfg *Config) []string {
+	data, _ := yaml.Marshal(redacted(cfg))
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+}
+
+// redacted returns a copy of cfg with every key, token and password replaced by redact
+func redacted(cfg *Config) *Config {
+	r := *cfg
+	r.Key = redact(cfg.Key)
+	r.NextKey = redact(cfg.NextKey)
+	r.Admin.Token = redact(cfg.Admin.Token)
+
+	if cfg.Socks.Users != nil {
+		r.Socks.Users = make(map[string]string, len(cfg.Socks.Users))
+		for user, password := range cfg.Socks.Users {
+			r.Socks.Users[user] = redact(password)
+		}
+	}
+
+	r.Auth.Tokens = slices.Clone(cfg.Auth.Tokens)
+	for i := range r.Auth.Tokens {
+		r.Auth.Tokens[i].Token = redact(r.Auth.Tokens[i].Token)
+	}
+
+	if cfg.ExitGroups != nil {
+		r.ExitGroups = make(map[string]rulesengine.ExitGroup, len(cfg.ExitGroups))
+		for name, group := range cfg.ExitGroups {
+			group.Key = redact(group.Key)
+			group.Nodes = slices.Clone(group.Nodes)
+			for i := range group.Nodes {
+				group.Nodes[i] = *redactedNode(&group.Nodes[i])
+			}
+			r.ExitGroups[name] = group
+		}
+	}
+
+	r.Rules = slices.Clone(cfg.Rules)
+	for i := range r.Rules {
+		r.Rules[i].Exit = redactedNode(r.Rules[i].Exit)
+	}
+
+	if cfg.Lists != nil {
+		r.Lists = make(map[string]domainlist.Source, len(cfg.Lists))
+		for name, source := range cfg.Lists {
+			source.URL = redactedURL(source.URL)
+			r.Lists[name] = source
+		}
+	}
+	return &r
+}
+
+// redactedURL removes the user info and query from a list URL as either may hold a token
+func redactedURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return rawURL
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+func redactedNode(node *rulesengine.ExiteNode) *rulesengine.ExiteNode {
+	if node == nil {
+		return nil
+	}
+	r := *node
+	r.Key = redact(node.Key)
+	r.Via = redactedNode(node.Via)
+	return &r
+}
+
+// redact replaces a secret with a short keyed hash of it, empty values are left empty
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(redactKey))
+	mac.Write([]byte(secret))
+	return "<redacted " + hex.EncodeToString(mac.Sum(nil)[:4]) + ">"
+}
+
+// diffLines is a longest common subsequence diff, configs are small enough for the quadratic table
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "-"+a[i])
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+"+b[j])
+	}
+	return diff
+}
+
+// Watch polls filePath and calls onChange when it changes, it does not return
+func Watch(filePath string, interval time.Duration, onChange func()) {
+	filewatch.Watch(filePath, interval, func() {
+		slog.Info("config file changed, reloading", "path", filePath)
+		onChange()
+	})
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rhysbryant/proxylink/pkg/auth"
+	"github.com/rhysbryant/proxylink/pkg/domainlist"
+	"github.com/rhysbryant/proxylink/pkg/rulesengine"
+)
+
+func TestDiffRedaction(t *testing.T) {
+	const secret = "hunter2-secret-value"
+
+	tests := []struct {
+		name string
+		// sets the secret somewhere in the config
+		set func(cfg *Config)
+		// shown in place of the secret, a redacted value when empty
+		visible string
+	}{
+		{name: "wsKey", set: func(cfg *Config) { cfg.Key = secret }},
+		{name: "nextKey", set: func(cfg *Config) { cfg.NextKey = secret }},
+		{name: "admin token", set: func(cfg *Config) { cfg.Admin.Token = secret }},
+		{name: "socks password", set: func(cfg *Config) { cfg.Socks.Users = map[string]string{"alice": secret} }},
+		{name: "auth token", set: func(cfg *Config) { cfg.Auth.Tokens = []auth.Token{{User: "ci", Token: secret}} }},
+		{name: "exit group key", set: func(cfg *Config) {
+			cfg.ExitGroups = map[string]rulesengine.ExitGroup{"eu": {Key: secret}}
+		}},
+		{name: "exit group node key", set: func(cfg *Config) {
+			cfg.ExitGroups = map[string]rulesengine.ExitGroup{"eu": {Nodes: []rulesengine.ExiteNode{{URL: "wss://a", Key: secret}}}}
+		}},
+		{name: "rule proxy key", set: func(cfg *Config) {
+			cfg.Rules = []rulesengine.Rule{{Exit: &rulesengine.ExiteNode{URL: "wss://a", Key: secret}}}
+		}},
+		{name: "rule via key", set: func(cfg *Config) {
+			cfg.Rules = []rulesengine.Rule{{Exit: &rulesengine.ExiteNode{URL: "wss://a", Via: &rulesengine.ExiteNode{URL: "wss://b", Key: secret}}}}
+		}},
+		{name: "list url user info", set: func(cfg *Config) {
+			cfg.Lists = map[string]domainlist.Source{"ads": {URL: "https://user:" + secret + "@lists.example.com/ads.txt"}}
+		}, visible: "https://lists.example.com/ads.txt"},
+		{name: "list url query", set: func(cfg *Config) {
+			cfg.Lists = map[string]domainlist.Source{"ads": {URL: "https://lists.example.com/ads.txt?token=" + secret}}
+		}, visible: "https://lists.example.com/ads.txt"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			old := &Config{}
+			new := &Config{}
+			test.set(new)
+
+			diff := Diff(old, new)
+			if len(diff) == 0 {
+				t.Fatal("no difference reported")
+			}
+			joined := strings.Join(diff, "\n")
+			if strings.Contains(joined, secret) {
+				t.Errorf("secret logged in diff:\n%s", joined)
+			}
+			visible := test.visible
+			if visible == "" {
+				visible = "<redacted "
+			}
+			if !strings.Contains(joined, visible) {
+				t.Errorf("changed setting not shown as %q:\n%s", visible, joined)
+			}
+		})
+	}
+}
+
+func TestDiffKeepsConfigUnchanged(t *testing.T) {
+	cfg := &Config{
+		Key:   "a",
+		Socks: SocksConfig{Users: map[string]string{"alice": "b"}},
+		Rules: []rulesengine.Rule{{Exit: &rulesengine.ExiteNode{URL: "wss://a", Key: "c"}}},
+	}
+	Diff(&Config{}, cfg)
+
+	if cfg.Key != "a" || cfg.Socks.Users["alice"] != "b" || cfg.Rules[0].Exit.Key != "c" {
+		t.Error("redacting the diff changed the config")
+	}
+}
+
+func TestDiffShowsSettings(t *testing.T) {
+	old := &Config{Rules: []rulesengine.Rule{{Target: []string{"example.com"}}}}
+	new := &Config{Rules: []rulesengine.Rule{{Target: []string{"example.org"}}}}
+
+	diff := strings.Join(Diff(old, new), "\n")
+	if !strings.Contains(diff, "-  - example.com") || !strings.Contains(diff, "+  - example.org") {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+}
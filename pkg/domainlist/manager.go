@@ -0,0 +1,290 @@
+package domainlist
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rhysbryant/proxylink/pkg/metrics"
+)
+
+// fetchTimeout limits downloading a list, some are tens of megabytes
+const fetchTimeout = 2 * time.Minute
+
+// Source is where a list is read from
+type Source struct {
+	URL     string        `yaml:"url"`     // http or https URL, or the path of a local file
+	Refresh time.Duration `yaml:"refresh"` // how often the list is checked for changes, it is only loaded with the config if 0
+}
+
+func (s Source) remote() bool {
+	return strings.HasPrefix(s.URL, "http://") || strings.HasPrefix(s.URL, "https://")
+}
+
+// Status describes a loaded list for the admin API
+type Status struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Refresh   string    `json:"refresh,omitempty"`
+	Entries   int       `json:"entries"`
+	Skipped   int       `json:"skipped"`
+	LoadedAt  time.Time `json:"loadedAt"`
+	CheckedAt time.Time `json:"checkedAt"`
+	// the last refresh failed and the list loaded before it is still used
+	Error string `json:"error,omitempty"`
+}
+
+type listState struct {
+	list      *List
+	checkedAt time.Time
+	err       error
+}
+
+// Manager loads the lists named in the config and refreshes them in the background
+type Manager struct {
+	client *http.Client
+	// called after a refresh changed a list, not for lists loaded by Load
+	onChange func()
+
+	mu     sync.Mutex
+	lists  map[string]*listState
+	cancel context.CancelFunc
+}
+
+// NewManager returns a manager without lists, onChange is called after a list is refreshed with new content
+func NewManager(onChange func()) *Manager {
+	return &Manager{
+		client:   &http.Client{Timeout: fetchTimeout},
+		onChange: onChange,
+		lists:    map[string]*listState{},
+		cancel:   func() {},
+	}
+}
+
+// Load reads the lists for sources, lists in use from the same source are reused instead of being read again.
+// nothing changes until the lists are passed to Use, so a config that is rejected leaves the running lists alone
+func (m *Manager) Load(sources map[string]Source) (map[string]*List, error) {
+	m.mu.Lock()
+	current := map[string]*List{}
+	for name, state := range m.lists {
+		current[name] = state.list
+	}
+	m.mu.Unlock()
+
+	lists := map[string]*List{}
+	for name, source := range sources {
+		if list, ok := current[name]; ok && list.source == source {
+			lists[name] = list
+			continue
+		}
+
+		list, err := m.fetch(context.Background(), source, nil)
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", name, err)
+		}
+		slog.Info("domain list loaded", "list", name, "url", source.URL, "entries", list.Len(), "skipped", list.Skipped)
+		lists[name] = list
+	}
+	return lists, nil
+}
+
+// Use makes lists the ones refreshed and reported, replacing those from an earlier call
+func (m *Manager) Use(lists map[string]*List) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cancel()
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	metrics.DomainListEntries.Reset()
+	m.lists = map[string]*listState{}
+	for name, list := range lists {
+		m.lists[name] = &listState{list: list, checkedAt: list.loadedAt}
+		metrics.DomainListEntries.WithLabelValues(name).Set(float64(list.Len()))
+		if list.source.Refresh > 0 {
+			go m.refresh(ctx, name, list.source.Refresh)
+		}
+	}
+}
+
+// Lists returns the lists in use by name
+func (m *Manager) Lists() map[string]*List {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lists := make(map[string]*List, len(m.lists))
+	for name, state := range m.lists {
+		lists[name] = state.list
+	}
+	return lists
+}
+
+// Status returns the lists in use sorted by name
+func (m *Manager) Status() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(m.lists))
+	for name, state := range m.lists {
+		status := Status{
+			Name:      name,
+			URL:       state.list.source.URL,
+			Entries:   state.list.Len(),
+			Skipped:   state.list.Skipped,
+			LoadedAt:  state.list.loadedAt,
+			CheckedAt: state.checkedAt,
+		}
+		if state.list.source.Refresh > 0 {
+			status.Refresh = state.list.source.Refresh.String()
+		}
+		if state.err != nil {
+			status.Error = state.err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	slices.SortFunc(statuses, func(a, b Status) int { return cmp.Compare(a.Name, b.Name) })
+	return statuses
+}
+
+func (m *Manager) refresh(ctx context.Context, name string, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		if ctx.Err() != nil {
+			m.mu.Unlock()
+			return
+		}
+		previous := m.lists[name].list
+		m.mu.Unlock()
+
+		list, err := m.fetch(ctx, previous.source, previous)
+
+		m.mu.Lock()
+		// Use replaced the lists while this one was being read
+		if ctx.Err() != nil {
+			m.mu.Unlock()
+			return
+		}
+		state := m.lists[name]
+		state.checkedAt = time.Now()
+		state.err = err
+		if err == nil {
+			state.list = list
+		}
+		m.mu.Unlock()
+
+		if err != nil {
+			slog.Warn("failed to refresh domain list, keeping the entries loaded before", "list", name, "url", previous.source.URL, "error", err)
+			continue
+		}
+		if list == previous {
+			continue
+		}
+
+		slog.Info("domain list refreshed", "list", name, "entries", list.Len(), "skipped", list.Skipped)
+		metrics.DomainListEntries.WithLabelValues(name).Set(float64(list.Len()))
+		m.onChange()
+	}
+}
+
+// fetch reads the list from source, previous is returned when it is unchanged
+func (m *Manager) fetch(ctx context.Context, source Source, previous *List) (*List, error) {
+	if source.remote() {
+		return m.fetchURL(ctx, source, previous)
+	}
+
+	info, err := os.Stat(source.URL)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && info.ModTime().Equal(previous.modTime) && info.Size() == previous.size {
+		return previous, nil
+	}
+
+	file, err := os.Open(source.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list, err := Parse(file)
+	if err != nil {
+		return nil, err
+	}
+	list.source = source
+	list.loadedAt = time.Now()
+	list.modTime = info.ModTime()
+	list.size = info.Size()
+	return list, nil
+}
+
+func (m *Manager) fetchURL(ctx context.Context, source Source, previous *List) (*List, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		if previous.etag != "" {
+			req.Header.Set("If-None-Match", previous.etag)
+		}
+		if previous.lastModified != "" {
+			req.Header.Set("If-Modified-Since", previous.lastModified)
+		}
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && previous != nil {
+		return previous, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+
+	list, err := Parse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	list.source = source
+	list.loadedAt = time.Now()
+	list.etag = resp.Header.Get("ETag")
+	list.lastModified = resp.Header.Get("Last-Modified")
+	return list, nil
+}
@@ -0,0 +1,167 @@
+package domainlist
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* External domain lists.
+
+blocklists published for ad blockers and DNS sinkholes are read so rules can reference them instead of listing
+hostnames in the config. three formats are understood, and may be mixed in one file:
+
+	0.0.0.0 ads.example.com   hosts file, the hostnames on the line only
+	tracker.example.com       a domain per line, the domain and its subdomains
+	||ads.example.com^        Adblock, the domain and its subdomains
+
+comments, Adblock rules with paths, wildcards or options and cosmetic filters are skipped.
+
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// maxLineLength is the longest line read, Adblock lists have some long cosmetic filters
+const maxLineLength = 1024 * 1024
+
+// names found at the top of most hosts files that are not meant to be blocked
+var hostsFileNames = map[string]struct{}{
+	"localhost": {}, "localhost.localdomain": {}, "local": {}, "broadcasthost": {}, "0.0.0.0": {},
+	"ip6-localhost": {}, "ip6-loopback": {}, "ip6-localnet": {}, "ip6-mcastprefix": {},
+	"ip6-allnodes": {}, "ip6-allrouters": {}, "ip6-allhosts": {},
+}
+
+// List is the hostnames read from a list, it is not changed once loaded
+type List struct {
+	// matched with their subdomains, from domain per line and Adblock entries
+	Domains []string
+	// matched on their own, from hosts file entries
+	Hosts []string
+	// lines that were not comments but could not be used
+	Skipped int
+
+	source   Source
+	loadedAt time.Time
+	// used to skip unchanged lists when refreshing
+	etag, lastModified string
+	modTime            time.Time
+	size               int64
+}
+
+// Len returns the number of hostnames in the list
+func (l *List) Len() int {
+	return len(l.Domains) + len(l.Hosts)
+}
+
+// Parse reads a list in any of the supported formats
+func Parse(r io.Reader) (*List, error) {
+	list := &List{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineLength)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		if rest, ok := strings.CutPrefix(line, "||"); ok {
+			domain, after, _ := strings.Cut(rest, "^")
+			// options such as $third-party narrow the rule, blocking the whole domain would go too far
+			if after != "" || !validHost(domain) {
+				list.Skipped++
+				continue
+			}
+			list.Domains = append(list.Domains, normalize(domain))
+			continue
+		}
+		// cosmetic filters such as example.com##.banner
+		if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") {
+			list.Skipped++
+			continue
+		}
+
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		// other Adblock rules, exceptions and URL patterns
+		if strings.ContainsAny(line, "|^$/@") {
+			list.Skipped++
+			continue
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1 && validHost(strings.TrimPrefix(fields[0], "*.")):
+			list.Domains = append(list.Domains, normalize(strings.TrimPrefix(fields[0], "*.")))
+
+		case len(fields) > 1 && isAddr(fields[0]):
+			for _, host := range fields[1:] {
+				host = normalize(host)
+				if _, ignored := hostsFileNames[host]; ignored {
+					continue
+				}
+				if !validHost(host) {
+					list.Skipped++
+					continue
+				}
+				list.Hosts = append(list.Hosts, host)
+			}
+
+		default:
+			list.Skipped++
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read list: %w", err)
+	}
+	return list, nil
+}
+
+func normalize(host string) string {
+	return strings.Trim(strings.ToLower(host), ".")
+}
+
+func isAddr(value string) bool {
+	_, err := netip.ParseAddr(value)
+	return err == nil
+}
+
+// validHost reports whether host is made of dot separated labels of letters, digits, hyphens and underscores
+func validHost(host string) bool {
+	host = normalize(host)
+	if host == "" {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
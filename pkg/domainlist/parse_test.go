@@ -0,0 +1,91 @@
+package domainlist
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		domains []string
+		hosts   []string
+		skipped int
+	}{
+		{
+			name:    "domain per line",
+			input:   "tracker.example.com\nAds.Example.NET.\n*.wild.example.org\n",
+			domains: []string{"tracker.example.com", "ads.example.net", "wild.example.org"},
+		},
+		{
+			name:  "hosts file",
+			input: "127.0.0.1 localhost\n::1 ip6-localhost ip6-loopback\n0.0.0.0 0.0.0.0\n0.0.0.0 ads.example.com\n0.0.0.0 a.example.com b.example.com # two on a line\n",
+			hosts: []string{"ads.example.com", "a.example.com", "b.example.com"},
+		},
+		{
+			name:  "hosts file comment with a url",
+			input: "0.0.0.0 ads.example.com # see https://example.com/why\n",
+			hosts: []string{"ads.example.com"},
+		},
+		{
+			name:    "adblock",
+			input:   "[Adblock Plus 2.0]\n! comment\n||ads.example.com^\n||track.example.com\n",
+			domains: []string{"ads.example.com", "track.example.com"},
+		},
+		{
+			name:    "adblock rules that are skipped",
+			input:   "||ads.example.com^$third-party\n||example.com/banner^\nexample.com##.banner\nexample.com#@#.ad\n@@||good.example.com^\n/banner/*\n",
+			skipped: 6,
+		},
+		{
+			name:    "comments and blank lines",
+			input:   "# a comment\n\n   \n! adblock comment\nexample.com # trailing comment\n",
+			domains: []string{"example.com"},
+		},
+		{
+			name:    "invalid hostnames",
+			input:   "bad..example.com\n0.0.0.0 bad!host\nnot a domain\n||bad host^\n",
+			skipped: 4,
+		},
+		{
+			name:    "mixed formats",
+			input:   "0.0.0.0 host.example.com\n||adblock.example.com^\nplain.example.com\n",
+			domains: []string{"adblock.example.com", "plain.example.com"},
+			hosts:   []string{"host.example.com"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list, err := Parse(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(list.Domains, test.domains) {
+				t.Errorf("domains %q want %q", list.Domains, test.domains)
+			}
+			if !slices.Equal(list.Hosts, test.hosts) {
+				t.Errorf("hosts %q want %q", list.Hosts, test.hosts)
+			}
+			if list.Skipped != test.skipped {
+				t.Errorf("skipped %d want %d", list.Skipped, test.skipped)
+			}
+			if list.Len() != len(test.domains)+len(test.hosts) {
+				t.Errorf("len %d want %d", list.Len(), len(test.domains)+len(test.hosts))
+			}
+		})
+	}
+}
+
+func TestParseLongLine(t *testing.T) {
+	input := "example.com##" + strings.Repeat("a", 200*1024) + "\nads.example.com\n"
+	list, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(list.Domains, []string{"ads.example.com"}) || list.Skipped != 1 {
+		t.Errorf("got domains %q skipped %d", list.Domains, list.Skipped)
+	}
+}
@@ -0,0 +1,56 @@
+package filewatch
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* Polling for changes to a file.
+
+the file is checked with stat on an interval rather than with inotify or kqueue, so it works the same on every
+platform and for files replaced by a rename, as editors and config management tools usually do.
+
+*/
+
+import (
+	"os"
+	"time"
+)
+
+// Watch polls filePath every interval and calls onChange when its modification time or size changes, it does not
+// return. a file that is missing or cannot be read is skipped until it can be
+func Watch(filePath string, interval time.Duration, onChange func()) {
+	var lastModified time.Time
+	var lastSize int64
+	if info, err := os.Stat(filePath); err == nil {
+		lastModified = info.ModTime()
+		lastSize = info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(filePath)
+		if err != nil || (info.ModTime().Equal(lastModified) && info.Size() == lastSize) {
+			continue
+		}
+		lastModified = info.ModTime()
+		lastSize = info.Size()
+
+		onChange()
+	}
+}
@@ -0,0 +1,121 @@
+package geoip
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* GeoIP lookups.
+
+countries and autonomous systems are read from local MaxMind DB (.mmdb) files such as GeoLite2-Country and
+GeoLite2-ASN, nothing is looked up over the network. the files are memory mapped so replacing them with
+geoipupdate does not affect a running proxy, a restart loads the new data.
+
+*/
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	// used for anycast and satellite networks that have no country of their own
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+type asnRecord struct {
+	Number uint32 `maxminddb:"autonomous_system_number"`
+}
+
+// CountryDB finds the country of an address from a Country or City database
+type CountryDB struct {
+	reader *maxminddb.Reader
+}
+
+// ASNDB finds the autonomous system announcing an address from an ASN or ISP database
+type ASNDB struct {
+	reader *maxminddb.Reader
+}
+
+func open(path string) (*maxminddb.Reader, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database: %w", err)
+	}
+	built := time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC()
+	slog.Info("GeoIP database loaded", "path", path, "type", reader.Metadata.DatabaseType, "built", built.Format(time.DateOnly))
+	return reader, nil
+}
+
+// OpenCountry opens a database with country data
+func OpenCountry(path string) (*CountryDB, error) {
+	reader, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &CountryDB{reader: reader}, nil
+}
+
+// OpenASN opens a database with autonomous system data
+func OpenASN(path string) (*ASNDB, error) {
+	reader, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ASNDB{reader: reader}, nil
+}
+
+// Country returns the ISO code of the country addr is in, empty if it is not known
+func (db *CountryDB) Country(addr netip.Addr) string {
+	var record countryRecord
+	if err := db.reader.Lookup(net.IP(addr.Unmap().AsSlice()), &record); err != nil {
+		slog.Debug("GeoIP country lookup failed", "addr", addr, "error", err)
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
+
+// ASN returns the number of the autonomous system announcing addr, 0 if it is not known
+func (db *ASNDB) ASN(addr netip.Addr) uint32 {
+	var record asnRecord
+	if err := db.reader.Lookup(net.IP(addr.Unmap().AsSlice()), &record); err != nil {
+		slog.Debug("GeoIP ASN lookup failed", "addr", addr, "error", err)
+		return 0
+	}
+	return record.Number
+}
+
+func (db *CountryDB) Close() error {
+	return db.reader.Close()
+}
+
+func (db *ASNDB) Close() error {
+	return db.reader.Close()
+}
@@ -0,0 +1,104 @@
+package httputils
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	infoContextKey
+)
+
+// WithUser returns a shallow copy of r carrying the authenticated username
+func WithUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+}
+
+// UserFromRequest returns the authenticated username or an empty string for anonymous requests
+func UserFromRequest(r *http.Request) string {
+	user, _ := r.Context().Value(userContextKey).(string)
+	return user
+}
+
+// RequestInfo collects how a request was routed as it passes down the pipeline, for logging and metrics.
+// the first value set wins so the outermost component's choice is kept
+type RequestInfo struct {
+	mu       sync.Mutex
+	provider string
+	rule     string
+}
+
+// WithRequestInfo returns a shallow copy of r carrying a new RequestInfo
+func WithRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	info := &RequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), infoContextKey, info)), info
+}
+
+// RequestInfoFromRequest returns the RequestInfo carried by r or nil, the methods of a nil RequestInfo do nothing
+func RequestInfoFromRequest(r *http.Request) *RequestInfo {
+	info, _ := r.Context().Value(infoContextKey).(*RequestInfo)
+	return info
+}
+
+// SetProvider records the name of the provider handling the request
+func (i *RequestInfo) SetProvider(name string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.provider == "" {
+		i.provider = name
+	}
+}
+
+func (i *RequestInfo) Provider() string {
+	if i == nil {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.provider
+}
+
+// SetRule records the name of the rule that matched the request
+func (i *RequestInfo) SetRule(name string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.rule == "" {
+		i.rule = name
+	}
+}
+
+func (i *RequestInfo) Rule() string {
+	if i == nil {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rule
+}
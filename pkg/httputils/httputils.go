@@ -22,7 +22,35 @@ import (
 	"strings"
 )
 
-// CopyRequest copies the header of an HTTP request from src to dst.
+// hopByHopHeaders apply to a single connection and are not forwarded, RFC 9110 section 7.6.1.
+// Proxy-Connection is not standard but still sent by some clients
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHopHeaders removes the hop-by-hop headers and the headers the Connection header names
+func RemoveHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// CopyRequest copies the header of an HTTP request from src to dst, leaving out hop-by-hop headers.
 func CopyRequest(src *http.Request, dst *http.Request) {
 	// Copy headers from the original request
 	for key, values := range src.Header {
@@ -30,16 +58,23 @@ func CopyRequest(src *http.Request, dst *http.Request) {
 			dst.Header.Add(key, value)
 		}
 	}
+	RemoveHopByHopHeaders(dst.Header)
+	// the only TE value that may be forwarded, it tells the destination trailers can be sent
+	if te := src.Header.Get("Te"); strings.EqualFold(strings.TrimSpace(te), "trailers") {
+		dst.Header.Set("Te", "trailers")
+	}
 	dst.Method = src.Method
 	//dst.URL = src.URL
 	dst.Body = src.Body
 	dst.Host = src.Host
 }
 
-// CopyResponse copies the header of an HTTP response from src to dst.
+// CopyResponse copies the header of an HTTP response from src to dst, leaving out hop-by-hop headers.
 func CopyResponse(src *http.Response, dst http.ResponseWriter) {
 	// Copy headers from the original response
-	for key, values := range src.Header {
+	header := src.Header.Clone()
+	RemoveHopByHopHeaders(header)
+	for key, values := range header {
 		for _, value := range values {
 			dst.Header().Add(key, value)
 		}
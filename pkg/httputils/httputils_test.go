@@ -0,0 +1,74 @@
+package httputils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHopByHopHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		// the header of a copied request, responses and RemoveHopByHopHeaders never keep Te
+		want http.Header
+	}{
+		{
+			name:   "proxy authorization",
+			header: http.Header{"Proxy-Authorization": {"Basic YWxpY2U6c2VjcmV0"}, "Accept": {"*/*"}},
+			want:   http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name:   "standard hop-by-hop headers",
+			header: http.Header{"Keep-Alive": {"timeout=5"}, "Proxy-Connection": {"keep-alive"}, "Upgrade": {"websocket"}, "Transfer-Encoding": {"chunked"}, "Trailer": {"Expires"}},
+			want:   http.Header{},
+		},
+		{
+			name:   "named by connection",
+			header: http.Header{"Connection": {"close, X-Secret", "X-Other-Secret"}, "X-Secret": {"a"}, "X-Other-Secret": {"b"}, "X-Kept": {"c"}},
+			want:   http.Header{"X-Kept": {"c"}},
+		},
+		{
+			name:   "te trailers",
+			header: http.Header{"Te": {"trailers"}},
+			want:   http.Header{"Te": {"trailers"}},
+		},
+		{
+			name:   "te with codings",
+			header: http.Header{"Te": {"gzip, trailers"}},
+			want:   http.Header{},
+		},
+		{
+			name:   "te trailers named by connection",
+			header: http.Header{"Connection": {"TE"}, "Te": {"trailers"}},
+			want:   http.Header{"Te": {"trailers"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withoutTE := test.want.Clone()
+			withoutTE.Del("Te")
+
+			header := test.header.Clone()
+			RemoveHopByHopHeaders(header)
+			if !reflect.DeepEqual(header, withoutTE) {
+				t.Errorf("RemoveHopByHopHeaders left %v want %v", header, withoutTE)
+			}
+
+			src := &http.Request{Method: http.MethodGet, Header: test.header.Clone()}
+			dst := &http.Request{Header: http.Header{}}
+			CopyRequest(src, dst)
+			if !reflect.DeepEqual(dst.Header, test.want) {
+				t.Errorf("CopyRequest copied %v want %v", dst.Header, test.want)
+			}
+
+			recorder := httptest.NewRecorder()
+			CopyResponse(&http.Response{StatusCode: http.StatusOK, Header: test.header.Clone()}, recorder)
+			if !reflect.DeepEqual(recorder.Header(), withoutTE) {
+				t.Errorf("CopyResponse copied %v want %v", recorder.Header(), withoutTE)
+			}
+		})
+	}
+}
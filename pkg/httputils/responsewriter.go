@@ -18,23 +18,42 @@ package httputils
 */
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
+
+	"github.com/rhysbryant/proxylink/pkg/ioutils"
 )
 
+// ResponseWriter is a http.ResponseWriter for requests that did not arrive through net/http,
+// such as requests read from a websocket tunnel or translated from another proxy protocol
 type ResponseWriter struct {
-	conn   io.ReadWriter
-	header http.Header
-	status int
+	conn     io.ReadWriter
+	header   http.Header
+	status   int
+	onStatus func(status int) error
 }
 
 func NewResponseWriter(conn io.ReadWriter) *ResponseWriter {
 	return &ResponseWriter{conn: conn}
 }
 
+// NewStatusResponseWriter returns a ResponseWriter that passes the response status to onStatus instead of
+// writing an HTTP response head, this lets front ends such as SOCKS translate the outcome into their own protocol.
+// HTTP response heads written to the hijacked connection are translated the same way
+func NewStatusResponseWriter(conn io.ReadWriter, onStatus func(status int) error) *ResponseWriter {
+	return &ResponseWriter{conn: conn, onStatus: onStatus}
+}
+
+// Status returns the status code written so far or 0 if none has been written
+func (w *ResponseWriter) Status() int {
+	return w.status
+}
+
 // Implement the Header method
 func (w *ResponseWriter) Header() http.Header {
 	if w.header == nil {
@@ -48,6 +67,10 @@ func (w *ResponseWriter) Write(data []byte) (int, error) {
 	if w.status == 0 {
 		w.WriteHeader(http.StatusOK)
 	}
+	if w.onStatus != nil && !isSuccess(w.status) {
+		// the client protocol has no way to carry an error body
+		return len(data), nil
+	}
 	return w.conn.Write(data)
 }
 
@@ -57,6 +80,12 @@ func (w *ResponseWriter) WriteHeader(statusCode int) {
 		return
 	}
 	w.status = statusCode
+
+	if w.onStatus != nil {
+		w.onStatus(statusCode)
+		return
+	}
+
 	response := bytes.Buffer{}
 	fmt.Fprintf(&response, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
 	for key, values := range w.header {
@@ -67,3 +96,58 @@ func (w *ResponseWriter) WriteHeader(statusCode int) {
 
 	w.conn.Write(response.Bytes())
 }
+
+// Hijack implements http.Hijacker so tunnel requests can take over the connection
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rwc, ok := w.conn.(io.ReadWriteCloser)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying connection does not support hijacking")
+	}
+	conn := ioutils.NewConn(rwc)
+
+	if w.onStatus != nil {
+		conn = &statusConn{Conn: conn, w: w}
+	}
+
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+func isSuccess(status int) bool {
+	return status >= 200 && status < 300
+}
+
+// statusConn translates the first HTTP response head written to a hijacked connection into a status callback
+type statusConn struct {
+	net.Conn
+	w    *ResponseWriter
+	head []byte
+}
+
+func (c *statusConn) Write(data []byte) (int, error) {
+	if c.w.status != 0 {
+		return c.Conn.Write(data)
+	}
+
+	c.head = append(c.head, data...)
+	end := bytes.Index(c.head, []byte("\r\n\r\n"))
+	if end < 0 {
+		return len(data), nil
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.head[:end+4])), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse response head: %w", err)
+	}
+
+	rest := c.head[end+4:]
+	c.head = nil
+	c.w.WriteHeader(resp.StatusCode)
+
+	if len(rest) > 0 && isSuccess(resp.StatusCode) {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
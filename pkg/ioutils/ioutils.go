@@ -18,13 +18,21 @@ package ioutils
 */
 
 import (
+	"bufio"
 	"io"
+	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// ByteCounter is called with the number of bytes copied each time a write completes
+type ByteCounter func(n int)
+
 // ByoDirectionalCopy copies data bidirectionally between two io.ReadWriteCloser streams.
-func ByoDirectionalCopy(dst io.ReadWriteCloser, src io.ReadWriteCloser) error {
+// src is the client side, bytes copied from src to dst are passed to upstream and those copied back to downstream,
+// either may be nil
+func ByoDirectionalCopy(dst io.ReadWriteCloser, src io.ReadWriteCloser, upstream, downstream ByteCounter) error {
 
 	wait := sync.WaitGroup{}
 	wait.Add(2)
@@ -37,7 +45,7 @@ func ByoDirectionalCopy(dst io.ReadWriteCloser, src io.ReadWriteCloser) error {
 
 	// Copy from src to dst
 	go func() {
-		_, err := io.Copy(dst, src)
+		_, err := io.Copy(countingWriter(dst, upstream), src)
 		if !firstClose.Load() && err != nil && err != io.EOF {
 			errForReturn = err
 		}
@@ -49,7 +57,7 @@ func ByoDirectionalCopy(dst io.ReadWriteCloser, src io.ReadWriteCloser) error {
 
 	// Copy from dst to src
 	go func() {
-		_, err := io.Copy(src, dst)
+		_, err := io.Copy(countingWriter(src, downstream), dst)
 		if !firstClose.Load() && err != nil && err != io.EOF {
 			errForReturn = err
 		}
@@ -63,3 +71,100 @@ func ByoDirectionalCopy(dst io.ReadWriteCloser, src io.ReadWriteCloser) error {
 	wait.Wait()
 	return errForReturn
 }
+
+// countingWriter passes the bytes written to count as they pass so long lived tunnels are visible while open
+func countingWriter(w io.Writer, count ByteCounter) io.Writer {
+	if count == nil {
+		return w
+	}
+	return &byteCountingWriter{Writer: w, count: count}
+}
+
+type byteCountingWriter struct {
+	io.Writer
+	count ByteCounter
+}
+
+func (w *byteCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count(n)
+	return n, err
+}
+
+// bufferedReadWriteCloser reads through a bufio.Reader that may already hold data from the underlying stream
+type bufferedReadWriteCloser struct {
+	io.ReadWriteCloser
+	reader *bufio.Reader
+}
+
+// NewBufferedReadWriteCloser returns rw with reads served from reader, use this after parsing a message
+// with a bufio.Reader so bytes buffered past the end of the message are not lost
+func NewBufferedReadWriteCloser(rw io.ReadWriteCloser, reader *bufio.Reader) io.ReadWriteCloser {
+	return &bufferedReadWriteCloser{ReadWriteCloser: rw, reader: reader}
+}
+
+func (b *bufferedReadWriteCloser) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// tunnelAddr is reported for connections that are not backed by a socket
+type tunnelAddr struct{}
+
+func (tunnelAddr) Network() string { return "tunnel" }
+func (tunnelAddr) String() string  { return "tunnel" }
+
+// rwcConn adapts an io.ReadWriteCloser to a net.Conn
+type rwcConn struct {
+	io.ReadWriteCloser
+	// the underlying connection, used for addresses and deadlines when it is a net.Conn
+	base io.ReadWriteCloser
+}
+
+// NewConn returns rwc as a net.Conn, addresses and deadlines come from the underlying
+// connection when it supports them and are otherwise placeholders and no-ops
+func NewConn(rwc io.ReadWriteCloser) net.Conn {
+	if conn, ok := rwc.(net.Conn); ok {
+		return conn
+	}
+
+	base := rwc
+	if b, ok := rwc.(*bufferedReadWriteCloser); ok {
+		base = b.ReadWriteCloser
+	}
+	return &rwcConn{ReadWriteCloser: rwc, base: base}
+}
+
+func (c *rwcConn) LocalAddr() net.Addr {
+	if conn, ok := c.base.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return tunnelAddr{}
+}
+
+func (c *rwcConn) RemoteAddr() net.Addr {
+	if conn, ok := c.base.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return tunnelAddr{}
+}
+
+func (c *rwcConn) SetDeadline(t time.Time) error {
+	if conn, ok := c.base.(net.Conn); ok {
+		return conn.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *rwcConn) SetReadDeadline(t time.Time) error {
+	if conn, ok := c.base.(net.Conn); ok {
+		return conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *rwcConn) SetWriteDeadline(t time.Time) error {
+	if conn, ok := c.base.(net.Conn); ok {
+		return conn.SetWriteDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package keyring
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* A set of named client keys for the exit node.
+
+bridges identify the key they use by sending its fingerprint in the websocket upgrade request,
+the fingerprint is a truncated hash so it does not reveal the key itself.
+
+the keyring file is YAML (or JSON)
+
+	keys:
+	  - name: alice-laptop
+	    key: <64 hex chars>
+	  - name: office-bridge
+	    key: <64 hex chars>
+	    revoked: true
+
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/rhysbryant/proxylink/pkg/filewatch"
+	"gopkg.in/yaml.v2"
+)
+
+const KeySize = 32
+
+// DefaultKeyName is the name given to the key set with --ws-key
+const DefaultKeyName = "default"
+
+type Key struct {
+	Name    string `yaml:"name"`
+	Key     string `yaml:"key"`     // 32-byte key in hex
+	Revoked bool   `yaml:"revoked"` // revoked keys are kept in the file for reference but never accepted
+}
+
+type keyringFile struct {
+	Keys []Key `yaml:"keys"`
+}
+
+type entry struct {
+	name string
+	key  []byte
+}
+
+// Keyring holds the active keys, it is immutable once created
+type Keyring struct {
+	byFingerprint map[string]entry
+	byName        map[string]entry
+}
+
+// Fingerprint returns the identifier a bridge sends for key
+func Fingerprint(key []byte) string {
+	sum := sha256.Sum256(append([]byte("proxylink key id\x00"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewKeyring validates keys and returns a keyring of the keys that are not revoked
+func NewKeyring(keys []Key) (*Keyring, error) {
+	kr := &Keyring{byFingerprint: map[string]entry{}, byName: map[string]entry{}}
+
+	for _, k := range keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("keyring entry without a name")
+		}
+		if _, exists := kr.byName[k.Name]; exists {
+			return nil, fmt.Errorf("duplicate key name %s", k.Name)
+		}
+
+		key, err := hex.DecodeString(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: failed to decode: %w", k.Name, err)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key %s: must be %d bytes long", k.Name, KeySize)
+		}
+
+		if k.Revoked {
+			continue
+		}
+
+		e := entry{name: k.Name, key: key}
+		fingerprint := Fingerprint(key)
+		if other, exists := kr.byFingerprint[fingerprint]; exists {
+			return nil, fmt.Errorf("keys %s and %s are identical", other.name, k.Name)
+		}
+		kr.byFingerprint[fingerprint] = e
+		kr.byName[k.Name] = e
+	}
+
+	return kr, nil
+}
+
+// LoadKeyring reads a keyring file, extra keys such as the one set with --ws-key are added to it
+func LoadKeyring(filePath string, extra ...Key) (*Keyring, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring file: %w", err)
+	}
+
+	var file keyringFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring file: %w", err)
+	}
+
+	return NewKeyring(append(file.Keys, extra...))
+}
+
+// Lookup returns the key with the given fingerprint
+func (kr *Keyring) Lookup(fingerprint string) (name string, key []byte, ok bool) {
+	if kr == nil {
+		return "", nil, false
+	}
+	e, ok := kr.byFingerprint[fingerprint]
+	return e.name, e.key, ok
+}
+
+// Default returns the key used for bridges that do not send a fingerprint,
+// this is the key named default or the only key if there is just one
+func (kr *Keyring) Default() (name string, key []byte, ok bool) {
+	if kr == nil {
+		return "", nil, false
+	}
+	if e, ok := kr.byName[DefaultKeyName]; ok {
+		return e.name, e.key, true
+	}
+	if len(kr.byName) == 1 {
+		for _, e := range kr.byName {
+			return e.name, e.key, true
+		}
+	}
+	return "", nil, false
+}
+
+// Contains reports whether a key with this name and value is still active
+func (kr *Keyring) Contains(name string, key []byte) bool {
+	if kr == nil {
+		return false
+	}
+	e, ok := kr.byName[name]
+	return ok && bytes.Equal(e.key, key)
+}
+
+// Len returns the number of active keys
+func (kr *Keyring) Len() int {
+	if kr == nil {
+		return 0
+	}
+	return len(kr.byName)
+}
+
+// Watch polls filePath and calls onChange with the new keyring whenever the file is modified.
+// a file that fails to load is logged and the previous keyring stays in use
+func Watch(filePath string, interval time.Duration, onChange func(*Keyring), extra ...Key) {
+	filewatch.Watch(filePath, interval, func() {
+		kr, err := LoadKeyring(filePath, extra...)
+		if err != nil {
+			slog.Error("failed to reload keyring, keeping the previous keys", "error", err)
+			return
+		}
+
+		slog.Info("keyring reloaded", "keys", kr.Len())
+		onChange(kr)
+	})
+}
@@ -0,0 +1,138 @@
+package metrics
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* Prometheus metrics for the proxy.
+
+collectors are package level so any part of the pipeline can record to them,
+they are registered with Registry which is served by the admin listener.
+
+*/
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "proxylink"
+
+// Registry holds every proxylink collector along with the Go runtime and process collectors
+var Registry = prometheus.NewRegistry()
+
+var mode atomic.Value
+
+var (
+	RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Requests processed by mode, method, provider and response status.",
+	}, []string{"mode", "method", "provider", "status"})
+
+	TunnelDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "tunnel_duration_seconds",
+		Help:      "How long CONNECT tunnels stayed open.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 15, 30, 60, 300, 900, 3600},
+	}, []string{"mode", "provider"})
+
+	BytesTransferred = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tunnel_bytes_total",
+		Help:      "Bytes relayed through tunnels, upstream is from the client towards the destination.",
+	}, []string{"direction"})
+
+	ExitNodeDialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exit_node_dial_failures_total",
+		Help:      "Failed WebSocket connections to exit nodes.",
+	}, []string{"node"})
+
+	RuleMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rule_matches_total",
+		Help:      "Requests matched by each rule.",
+	}, []string{"rule"})
+
+	ActiveConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_connections",
+		Help:      "Requests, tunnels and UDP associations in progress.",
+	}, []string{"kind"})
+
+	DomainListEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "domain_list_entries",
+		Help:      "Hostnames loaded from each external domain list.",
+	}, []string{"list"})
+)
+
+func init() {
+	mode.Store("")
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RequestsTotal,
+		TunnelDuration,
+		BytesTransferred,
+		ExitNodeDialFailures,
+		RuleMatches,
+		ActiveConnections,
+		DomainListEntries,
+	)
+}
+
+// SetMode sets the mode label recorded with requests, call it once at startup
+func SetMode(m string) {
+	mode.Store(m)
+}
+
+// Mode returns the mode label set with SetMode
+func Mode() string {
+	return mode.Load().(string)
+}
+
+// StatusLabel formats a response status for the status label, 0 means no response was written
+func StatusLabel(status int) string {
+	if status == 0 {
+		return "none"
+	}
+	return strconv.Itoa(status)
+}
+
+// MethodLabel returns method for the method label when it is a standard HTTP method and OTHER when it is not,
+// the method comes from the client so any other value would add a new series
+func MethodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
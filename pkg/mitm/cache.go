@@ -0,0 +1,91 @@
+package mitm
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the number of leaf certificates kept when no size is configured
+const DefaultCacheSize = 1000
+
+// leaves are signed again once less than this is left before they expire
+const renewBefore = 24 * time.Hour
+
+// certCache keeps the most recently used leaf certificates
+type certCache struct {
+	size int
+	// leaves expire no later than the CA, signing those again would not give them any longer
+	caExpiry time.Time
+
+	mu    sync.Mutex
+	order *list.List // front is the most recently used, elements hold a *cacheEntry
+	hosts map[string]*list.Element
+}
+
+type cacheEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+func newCertCache(size int, caExpiry time.Time) *certCache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	return &certCache{size: size, caExpiry: caExpiry, order: list.New(), hosts: map[string]*list.Element{}}
+}
+
+func (c *certCache) get(host string) *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.hosts[host]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	notAfter := entry.cert.Leaf.NotAfter
+	if time.Until(notAfter) < renewBefore && notAfter.Before(c.caExpiry) {
+		c.order.Remove(element)
+		delete(c.hosts, host)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return entry.cert
+}
+
+func (c *certCache) add(host string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.hosts[host]; ok {
+		element.Value.(*cacheEntry).cert = cert
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.hosts[host] = c.order.PushFront(&cacheEntry{host: host, cert: cert})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.hosts, oldest.Value.(*cacheEntry).host)
+	}
+}
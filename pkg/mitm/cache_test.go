@@ -0,0 +1,56 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestCacheRenewal(t *testing.T) {
+	caExpiry := time.Now().Add(12 * time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		cached   bool
+	}{
+		{name: "valid", notAfter: time.Now().Add(leafLifetime), cached: true},
+		{name: "about to expire", notAfter: time.Now().Add(time.Hour), cached: false},
+		// signing again would give a leaf expiring at the same time
+		{name: "expires with the CA", notAfter: caExpiry, cached: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := newCertCache(10, caExpiry)
+			cert := &tls.Certificate{Leaf: &x509.Certificate{NotAfter: test.notAfter}}
+			cache.add("example.com", cert)
+
+			got := cache.get("example.com")
+			if test.cached && got != cert {
+				t.Error("certificate not returned from the cache")
+			}
+			if !test.cached && got != nil {
+				t.Error("certificate about to expire returned from the cache")
+			}
+		})
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := newCertCache(2, time.Now().Add(leafLifetime*2))
+	cert := &tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now().Add(leafLifetime)}}
+	cache.add("a.example.com", cert)
+	cache.add("b.example.com", cert)
+	// a is now the most recently used
+	cache.get("a.example.com")
+	cache.add("c.example.com", cert)
+
+	if cache.get("b.example.com") != nil {
+		t.Error("least recently used certificate kept")
+	}
+	if cache.get("a.example.com") == nil || cache.get("c.example.com") == nil {
+		t.Error("recently used certificate evicted")
+	}
+}
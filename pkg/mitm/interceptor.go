@@ -0,0 +1,180 @@
+package mitm
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rhysbryant/proxylink/pkg/httputils"
+)
+
+// ProviderName is reported as the provider of intercepted tunnels, the requests inside them report their own
+const ProviderName = "INTERCEPT"
+
+const (
+	handshakeTimeout  = 10 * time.Second
+	readHeaderTimeout = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+type Interceptor struct {
+	ca    *CA
+	cache *certCache
+
+	// a single signing per host when several tunnels to it start at once
+	signMu sync.Mutex
+}
+
+// NewInterceptor returns an interceptor signing leaf certificates with ca, cacheSize of them are kept
+func NewInterceptor(ca *CA, cacheSize int) *Interceptor {
+	return &Interceptor{ca: ca, cache: newCertCache(cacheSize, ca.cert.NotAfter)}
+}
+
+func (ic *Interceptor) certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if cert := ic.cache.get(host); cert != nil {
+		return cert, nil
+	}
+
+	ic.signMu.Lock()
+	defer ic.signMu.Unlock()
+	if cert := ic.cache.get(host); cert != nil {
+		return cert, nil
+	}
+
+	cert, err := ic.ca.sign(host)
+	if err != nil {
+		return nil, err
+	}
+	ic.cache.add(host, cert)
+	return cert, nil
+}
+
+// Intercept accepts the CONNECT request r, terminates the client's TLS and passes each decrypted request to handler
+// as a plain request for the https URL of the CONNECT target. it returns once the client closes the connection
+func (ic *Interceptor) Intercept(r *http.Request, w http.ResponseWriter, handler httputils.RequestProcessor) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return errors.New("hijacking not supported")
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		return fmt.Errorf("failed to hijack connection: %w", err)
+	}
+	defer clientConn.Close()
+
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return fmt.Errorf("failed to write connection established response: %w", err)
+	}
+
+	target := httputils.GetTLSHostFromRequest(r)
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// clients connecting to an IP address send no server name
+			if hello.ServerName != "" {
+				return ic.certificate(hello.ServerName)
+			}
+			return ic.certificate(r.URL.Hostname())
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.HandshakeContext(r.Context()); err != nil {
+		// clients that pin certificates or do not trust the CA end up here, a rule can bypass interception for them
+		return fmt.Errorf("TLS handshake with client failed: %w", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	user := httputils.UserFromRequest(r)
+	listener := newConnListener(tlsConn)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.URL.Scheme = "https"
+			// requests always go to the host the tunnel was opened to, whatever their Host header says
+			req.URL.Host = target
+			req.RemoteAddr = r.RemoteAddr
+			req.RequestURI = ""
+			handler.ProcessRequest(httputils.WithUser(req, user), w)
+		}),
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		ConnState:         listener.connState,
+		ErrorLog:          log.New(io.Discard, "", 0),
+	}
+
+	// the tunnel being closed, by a drain or the admin API, ends the connection
+	stop := context.AfterFunc(r.Context(), func() { server.Close() })
+	defer stop()
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// connListener hands a single connection to an http.Server, Accept blocks after that until the connection is closed
+type connListener struct {
+	conn      net.Conn
+	accepted  bool
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, done: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if !l.accepted {
+		l.accepted = true
+		l.mu.Unlock()
+		return l.conn, nil
+	}
+	l.mu.Unlock()
+
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		l.Close()
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
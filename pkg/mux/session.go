@@ -0,0 +1,480 @@
+package mux
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* A stream multiplexer that carries many logical streams over a single io.ReadWriteCloser,
+  typically a (possibly encrypted) websocket connection between the bridge and the exit node.
+
+every frame starts with a 9 byte header
+
+	type     uint8
+	streamID uint32 (big endian)
+	length   uint32 (big endian) payload length, window increment or ping id depending on type
+
+streams opened by the client side use odd ids, streams opened by the server side use even ids.
+each stream has its own receive window so a slow reader only stalls its own stream.
+
+a go away frame tells the peer not to open new streams on the session, the streams already open
+carry on and the peer closes the session once they finish. it is only sent to peers that negotiated ProtocolV2.
+
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// Protocol is the websocket sub protocol used to negotiate multiplexing with the exit node
+	Protocol = "proxylink-mux"
+	// ProtocolV2 adds the go away frame
+	ProtocolV2 = "proxylink-mux/2"
+)
+
+// Protocols are the supported sub protocols in order of preference
+var Protocols = []string{ProtocolV2, Protocol}
+
+// IsProtocol reports whether the negotiated sub protocol is multiplexed
+func IsProtocol(subprotocol string) bool {
+	return subprotocol == Protocol || subprotocol == ProtocolV2
+}
+
+const (
+	frameOpen uint8 = iota + 1
+	frameData
+	frameWindowUpdate
+	frameClose
+	frameReset
+	framePing
+	framePong
+	frameGoAway
+)
+
+const (
+	headerSize      = 9
+	maxFramePayload = 16 * 1024
+	initialWindow   = 256 * 1024
+
+	acceptBacklog     = 256
+	controlBacklog    = 1024
+	keepAliveInterval = 30 * time.Second
+	pingTimeout       = 10 * time.Second
+)
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamReset   = errors.New("mux: stream reset by peer")
+	ErrTimeout       = errors.New("mux: timeout")
+)
+
+// Session multiplexes streams over a single connection
+type Session struct {
+	conn   io.ReadWriteCloser
+	client bool
+
+	mu           sync.Mutex
+	streams      map[uint32]*Stream
+	nextStreamID uint32
+	pings        map[uint32]chan struct{}
+	nextPingID   uint32
+	// set by CloseWhenIdle or a go away from the peer, no new streams are opened and the session closes with its last stream
+	draining bool
+
+	writeMu sync.Mutex
+	// frames the receive loop sends, written by controlLoop so a peer that is blocked writing cannot block the receive loop
+	controlCh chan controlFrame
+
+	acceptCh  chan *Stream
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+type controlFrame struct {
+	frameType uint8
+	streamID  uint32
+	length    uint32
+}
+
+// NewClientSession starts a session on the dialing side of the connection.
+// client sessions send periodic pings and close the session if the peer stops responding
+func NewClientSession(conn io.ReadWriteCloser) *Session {
+	s := newSession(conn, true)
+	go s.keepAlive()
+	return s
+}
+
+// NewServerSession starts a session on the accepting side of the connection
+func NewServerSession(conn io.ReadWriteCloser) *Session {
+	return newSession(conn, false)
+}
+
+func newSession(conn io.ReadWriteCloser, client bool) *Session {
+	s := &Session{
+		conn:      conn,
+		client:    client,
+		streams:   map[uint32]*Stream{},
+		pings:     map[uint32]chan struct{}{},
+		acceptCh:  make(chan *Stream, acceptBacklog),
+		controlCh: make(chan controlFrame, controlBacklog),
+		closed:    make(chan struct{}),
+	}
+	if client {
+		s.nextStreamID = 1
+	} else {
+		s.nextStreamID = 2
+	}
+
+	go s.recvLoop()
+	go s.controlLoop()
+	return s
+}
+
+// OpenStream opens a new logical stream to the peer
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	if s.IsClosed() || s.draining {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextStreamID
+	s.nextStreamID += 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// AcceptStream waits for the peer to open a stream
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	}
+}
+
+// NumStreams returns the number of streams currently open on the session
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IsDraining reports whether the session no longer accepts new streams because it is closing or the peer is going away
+func (s *Session) IsDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining || s.IsClosed()
+}
+
+// IsClosed reports whether the session has been closed by either side
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Closed returns a channel that is closed when the session ends
+func (s *Session) Closed() <-chan struct{} {
+	return s.closed
+}
+
+// Err returns the reason the session was closed
+func (s *Session) Err() error {
+	select {
+	case <-s.closed:
+		return s.closeErr
+	default:
+		return nil
+	}
+}
+
+// Ping sends a ping to the peer and returns the round trip time
+func (s *Session) Ping() (time.Duration, error) {
+	ch := make(chan struct{})
+	s.mu.Lock()
+	id := s.nextPingID
+	s.nextPingID++
+	s.pings[id] = ch
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.writeFrame(framePing, 0, id, nil); err != nil {
+		return 0, err
+	}
+
+	timer := time.NewTimer(pingTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-s.closed:
+		return 0, ErrSessionClosed
+	case <-timer.C:
+		return 0, ErrTimeout
+	}
+}
+
+// Close closes the session and every stream on it
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+// CloseWhenIdle stops new streams being opened and closes the session once the open streams have finished
+func (s *Session) CloseWhenIdle() {
+	s.mu.Lock()
+	s.draining = true
+	idle := len(s.streams) == 0
+	s.mu.Unlock()
+
+	if idle {
+		s.Close()
+	}
+}
+
+// GoAway asks the peer to stop opening streams and close the session once the open streams finish,
+// streams the peer opened before receiving it are still accepted
+func (s *Session) GoAway() error {
+	return s.writeFrame(frameGoAway, 0, 0, nil)
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.closeErr = err
+		close(s.closed)
+		s.conn.Close()
+
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = map[uint32]*Stream{}
+		s.mu.Unlock()
+
+		for _, stream := range streams {
+			stream.abort(ErrSessionClosed)
+		}
+	})
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Ping(); err != nil {
+				slog.Debug("mux keepalive failed, closing session", "error", err)
+				s.closeWithError(fmt.Errorf("keepalive failed: %w", err))
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Session) writeFrame(frameType uint8, streamID uint32, length uint32, payload []byte) error {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = frameType
+	binary.BigEndian.PutUint32(buf[1:5], streamID)
+	binary.BigEndian.PutUint32(buf[5:9], length)
+	copy(buf[headerSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+
+	if _, err := s.conn.Write(buf); err != nil {
+		s.closeWithError(fmt.Errorf("failed to write frame: %w", err))
+		return err
+	}
+
+	return nil
+}
+
+// queueFrame sends a frame without payload from the receive loop, a peer that lets the queue fill up is not reading and the session is closed
+func (s *Session) queueFrame(frameType uint8, streamID uint32, length uint32) {
+	select {
+	case s.controlCh <- controlFrame{frameType: frameType, streamID: streamID, length: length}:
+	case <-s.closed:
+	default:
+		s.closeWithError(errors.New("mux: peer is not reading control frames"))
+	}
+}
+
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case frame := <-s.controlCh:
+			if err := s.writeFrame(frame.frameType, frame.streamID, frame.length, nil); err != nil {
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// peerStreamID reports whether id is one the peer may open, clients open odd ids and servers even ones
+func (s *Session) peerStreamID(id uint32) bool {
+	return id != 0 && (id%2 == 1) != s.client
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	idle := s.draining && len(s.streams) == 0
+	s.mu.Unlock()
+
+	if idle {
+		s.Close()
+	}
+}
+
+func (s *Session) recvLoop() {
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.closeWithError(err)
+			return
+		}
+
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+
+		if err := s.handleFrame(frameType, id, length); err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(frameType uint8, id uint32, length uint32) error {
+	switch frameType {
+	case frameOpen:
+		if !s.peerStreamID(id) {
+			return fmt.Errorf("mux: peer opened stream id %d reserved for this side", id)
+		}
+		s.mu.Lock()
+		if _, exists := s.streams[id]; exists {
+			s.mu.Unlock()
+			return fmt.Errorf("mux: duplicate stream id %d", id)
+		}
+		stream := newStream(s, id)
+		s.streams[id] = stream
+		s.mu.Unlock()
+
+		select {
+		case s.acceptCh <- stream:
+		default:
+			// backlog full, refuse the stream
+			s.removeStream(id)
+			s.queueFrame(frameReset, id, 0)
+		}
+
+	case frameData:
+		if length > maxFramePayload {
+			return fmt.Errorf("mux: frame payload of %d bytes exceeds limit", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return err
+		}
+
+		if stream := s.getStream(id); stream != nil {
+			if !stream.pushData(payload) {
+				// peer ignored our receive window
+				s.removeStream(id)
+				stream.abort(ErrStreamReset)
+				s.queueFrame(frameReset, id, 0)
+			}
+		}
+
+	case frameWindowUpdate:
+		if stream := s.getStream(id); stream != nil {
+			stream.addSendWindow(length)
+		}
+
+	case frameClose:
+		if stream := s.getStream(id); stream != nil {
+			stream.remoteClose()
+		}
+
+	case frameReset:
+		if stream := s.getStream(id); stream != nil {
+			s.removeStream(id)
+			stream.abort(ErrStreamReset)
+		}
+
+	case framePing:
+		s.queueFrame(framePong, 0, length)
+
+	case framePong:
+		s.mu.Lock()
+		ch, ok := s.pings[length]
+		delete(s.pings, length)
+		s.mu.Unlock()
+		if ok {
+			close(ch)
+		}
+
+	case frameGoAway:
+		slog.Debug("mux peer is going away, closing session when idle")
+		s.CloseWhenIdle()
+
+	default:
+		return fmt.Errorf("mux: unknown frame type %d", frameType)
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeRawFrame(t *testing.T, conn net.Conn, frameType uint8, id uint32, length uint32, payload []byte) {
+	t.Helper()
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = frameType
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint32(buf[5:9], length)
+	copy(buf[headerSize:], payload)
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatalf("failed to write frame: %v", err)
+	}
+}
+
+func readRawFrame(t *testing.T, conn net.Conn) (uint8, uint32, uint32) {
+	t.Helper()
+	header := make([]byte, headerSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("failed to read frame: %v", err)
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:5]), binary.BigEndian.Uint32(header[5:9])
+}
+
+func newPair(t *testing.T) (*Session, *Session) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	client := newSession(clientConn, true)
+	server := NewServerSession(serverConn)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStreamIDs(t *testing.T) {
+	tests := []struct {
+		client bool
+		id     uint32
+		peer   bool
+	}{
+		{client: false, id: 1, peer: true},
+		{client: false, id: 2, peer: false},
+		{client: true, id: 2, peer: true},
+		{client: true, id: 3, peer: false},
+		{client: true, id: 0, peer: false},
+		{client: false, id: 0, peer: false},
+	}
+	for _, test := range tests {
+		s := &Session{client: test.client}
+		if got := s.peerStreamID(test.id); got != test.peer {
+			t.Errorf("client=%v id=%d: got %v want %v", test.client, test.id, got, test.peer)
+		}
+	}
+}
+
+func TestOpenAcceptEcho(t *testing.T) {
+	client, server := newPair(t)
+
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		io.Copy(stream, stream)
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.ID()%2 != 1 {
+		t.Errorf("client opened stream %d, want an odd id", stream.ID())
+	}
+
+	message := bytes.Repeat([]byte("proxylink"), 10000)
+	go stream.Write(message)
+
+	got := make([]byte, len(message))
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, message) {
+		t.Error("echoed data differs")
+	}
+}
+
+func TestSendWindow(t *testing.T) {
+	client, server := newPair(t)
+
+	accepted := make(chan *Stream, 1)
+	go func() {
+		stream, _ := server.AcceptStream()
+		accepted <- stream
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+
+	// nothing is read so the writer stops once the peer's window is used up
+	stream.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	n, err := stream.Write(make([]byte, initialWindow+maxFramePayload))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got error %v, want a deadline error", err)
+	}
+	if n != initialWindow {
+		t.Fatalf("wrote %d bytes, want the window of %d", n, initialWindow)
+	}
+
+	// reading half the window hands it back to the writer
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(peer, make([]byte, initialWindow/2)); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Write(make([]byte, initialWindow/2)); err != nil {
+		t.Fatalf("write after window update failed: %v", err)
+	}
+}
+
+func TestHandleFrame(t *testing.T) {
+	full := make([]byte, maxFramePayload)
+
+	tests := []struct {
+		name string
+		// frames sent by the peer after opening stream 1
+		send func(t *testing.T, conn net.Conn)
+		// frame expected back
+		frameType uint8
+		streamID  uint32
+	}{
+		{
+			name: "window exceeded while the peer keeps writing",
+			send: func(t *testing.T, conn net.Conn) {
+				for sent := 0; sent < initialWindow; sent += len(full) {
+					writeRawFrame(t, conn, frameData, 1, uint32(len(full)), full)
+				}
+				writeRawFrame(t, conn, frameData, 1, 1, []byte{0})
+				// the session must keep reading even though the reset has not been read yet
+				for range 4 {
+					writeRawFrame(t, conn, frameData, 1, uint32(len(full)), full)
+				}
+			},
+			frameType: frameReset,
+			streamID:  1,
+		},
+		{
+			name: "ping",
+			send: func(t *testing.T, conn net.Conn) {
+				writeRawFrame(t, conn, framePing, 0, 42, nil)
+			},
+			frameType: framePong,
+			streamID:  0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peerConn, serverConn := net.Pipe()
+			server := NewServerSession(serverConn)
+			defer server.Close()
+			defer peerConn.Close()
+
+			writeRawFrame(t, peerConn, frameOpen, 1, 0, nil)
+			test.send(t, peerConn)
+
+			frameType, id, _ := readRawFrame(t, peerConn)
+			if frameType != test.frameType || id != test.streamID {
+				t.Errorf("got frame %d for stream %d, want %d for stream %d", frameType, id, test.frameType, test.streamID)
+			}
+			if server.IsClosed() {
+				t.Errorf("session closed: %v", server.Err())
+			}
+		})
+	}
+}
+
+func TestBacklogFull(t *testing.T) {
+	peerConn, serverConn := net.Pipe()
+	server := NewServerSession(serverConn)
+	defer server.Close()
+	defer peerConn.Close()
+
+	for i := range acceptBacklog + 1 {
+		writeRawFrame(t, peerConn, frameOpen, uint32(2*i+1), 0, nil)
+	}
+
+	frameType, id, _ := readRawFrame(t, peerConn)
+	if frameType != frameReset || id != 2*acceptBacklog+1 {
+		t.Errorf("got frame %d for stream %d, want a reset of stream %d", frameType, id, 2*acceptBacklog+1)
+	}
+}
+
+func TestRejectWrongParity(t *testing.T) {
+	peerConn, serverConn := net.Pipe()
+	server := NewServerSession(serverConn)
+	defer server.Close()
+	defer peerConn.Close()
+
+	// even ids are opened by the server side
+	writeRawFrame(t, peerConn, frameOpen, 2, 0, nil)
+
+	select {
+	case <-server.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session accepted a stream id reserved for the server")
+	}
+}
+
+func TestPing(t *testing.T) {
+	client, _ := newPair(t)
+	if _, err := client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,294 @@
+package mux
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a single logical connection within a Session, it implements net.Conn.
+// Close ends the stream in both directions, once the peer has closed its side
+// buffered data can still be read before Read returns io.EOF but writes fail
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu            sync.Mutex
+	recvBuf       bytes.Buffer
+	recvWindow    uint32 // bytes the peer is still allowed to send
+	consumed      uint32 // bytes read since the last window update
+	sendWindow    uint32 // bytes we are still allowed to send
+	localClosed   bool
+	remoteClosed  bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readReady  chan struct{}
+	writeReady chan struct{}
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is signalled, the deadline passes or the session closes
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		delay := time.Until(deadline)
+		if delay <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-st.session.closed:
+		return ErrSessionClosed
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// ID returns the stream identifier, unique within the session
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(p)
+			st.consumed += uint32(n)
+
+			// hand the window back once half of it has been consumed
+			var update uint32
+			if st.consumed >= initialWindow/2 && !st.remoteClosed {
+				update = st.consumed
+				st.recvWindow += update
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+
+			if update > 0 {
+				st.session.writeFrame(frameWindowUpdate, st.id, update, nil)
+			}
+			return n, nil
+		}
+
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+
+		if st.remoteClosed || st.localClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.readReady, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		}
+
+		if st.localClosed || st.remoteClosed {
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+
+			if err := st.wait(st.writeReady, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		n := min(uint32(len(p)-written), st.sendWindow, maxFramePayload)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(frameData, st.id, n, p[written:written+int(n)]); err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+
+	return written, nil
+}
+
+// Close closes the stream, pending reads return io.EOF and the peer is told no more data will be accepted
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	finished := st.remoteClosed || st.err != nil
+	aborted := st.err != nil
+	st.mu.Unlock()
+
+	notify(st.readReady)
+	notify(st.writeReady)
+
+	if finished {
+		st.session.removeStream(st.id)
+	}
+
+	if aborted {
+		return nil
+	}
+
+	return st.session.writeFrame(frameClose, st.id, 0, nil)
+}
+
+// pushData queues data received from the peer, it returns false if the peer exceeded the receive window
+func (st *Stream) pushData(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if uint32(len(data)) > st.recvWindow {
+		return false
+	}
+	st.recvWindow -= uint32(len(data))
+
+	if st.localClosed {
+		// nobody is going to read this
+		return true
+	}
+
+	st.recvBuf.Write(data)
+	notify(st.readReady)
+	return true
+}
+
+func (st *Stream) addSendWindow(increment uint32) {
+	st.mu.Lock()
+	st.sendWindow += increment
+	st.mu.Unlock()
+	notify(st.writeReady)
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	finished := st.localClosed
+	st.mu.Unlock()
+
+	notify(st.readReady)
+	notify(st.writeReady)
+
+	if finished {
+		st.session.removeStream(st.id)
+	}
+}
+
+func (st *Stream) abort(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+
+	notify(st.readReady)
+	notify(st.writeReady)
+}
+
+type addr string
+
+func (a addr) Network() string { return "mux" }
+func (a addr) String() string  { return string(a) }
+
+func (st *Stream) addr(get func(net.Conn) net.Addr) net.Addr {
+	if conn, ok := st.session.conn.(net.Conn); ok {
+		return get(conn)
+	}
+	return addr("mux")
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.addr(net.Conn.LocalAddr)
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.addr(net.Conn.RemoteAddr)
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readReady)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeReady)
+	return nil
+}
@@ -0,0 +1,138 @@
+package netpolicy
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* Destination policy for outgoing connections.
+
+stops the proxy being used to reach addresses only the host it runs on can reach, such as loopback services,
+the cloud metadata endpoint or the provider's internal network. the check runs on the address actually dialed,
+after the hostname is resolved, so a hostname that resolves to a public address when rules are matched and a
+private one when connecting is still refused.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// DefaultDeny are the ranges refused unless allowed explicitly
+var DefaultDeny = []string{
+	"0.0.0.0/8",          // this network, 0.0.0.0 connects to the local host
+	"10.0.0.0/8",         // private
+	"100.64.0.0/10",      // carrier grade NAT, often a provider's internal network
+	"127.0.0.0/8",        // loopback
+	"169.254.0.0/16",     // link local, includes the cloud metadata endpoint
+	"172.16.0.0/12",      // private
+	"192.168.0.0/16",     // private
+	"224.0.0.0/4",        // multicast
+	"255.255.255.255/32", // broadcast
+	"::/128",             // unspecified
+	"::1/128",            // loopback
+	"fc00::/7",           // unique local
+	"fe80::/10",          // link local
+	"ff00::/8",           // multicast
+}
+
+// ErrDenied is returned, wrapped, for connections the policy refuses
+var ErrDenied = errors.New("destination not allowed")
+
+type Policy struct {
+	deny      []netip.Prefix
+	allow     []netip.Prefix
+	denyPorts map[uint16]struct{}
+}
+
+// NewPolicy returns a policy refusing the DefaultDeny ranges, the deny ranges and the deny ports.
+// the allow ranges take precedence over the denied ranges but not over denied ports
+func NewPolicy(deny []string, allow []string, denyPorts []uint16) (*Policy, error) {
+	p := &Policy{denyPorts: map[uint16]struct{}{}}
+
+	var err error
+	if p.deny, err = ParsePrefixes(append(append([]string{}, DefaultDeny...), deny...)); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	if p.allow, err = ParsePrefixes(allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	for _, port := range denyPorts {
+		p.denyPorts[port] = struct{}{}
+	}
+	return p, nil
+}
+
+// ParsePrefixes parses addresses and CIDR ranges, a single address becomes a range holding only that address
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", value, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q: %w", value, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an error wrapping ErrDenied if the policy refuses addr
+func (p *Policy) Check(addr netip.AddrPort) error {
+	// zoned addresses such as fe80::1%eth0 are never contained in a range
+	ip := addr.Addr().Unmap().WithZone("")
+
+	if _, denied := p.denyPorts[addr.Port()]; denied {
+		return fmt.Errorf("%w: port %d", ErrDenied, addr.Port())
+	}
+	if contains(p.deny, ip) && !contains(p.allow, ip) {
+		return fmt.Errorf("%w: %s", ErrDenied, ip)
+	}
+	return nil
+}
+
+// Control checks the address about to be dialed, it is meant for net.Dialer.Control
+func (p *Policy) Control(network, address string, c syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrDenied, address)
+	}
+	return p.Check(addr)
+}
@@ -0,0 +1,121 @@
+package netpolicy
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestControl(t *testing.T) {
+	tests := []struct {
+		name      string
+		deny      []string
+		allow     []string
+		denyPorts []uint16
+		address   string
+		denied    bool
+	}{
+		{name: "public", address: "93.184.216.34:443"},
+		{name: "public ipv6", address: "[2606:2800:220:1::]:443"},
+		{name: "loopback", address: "127.0.0.1:80", denied: true},
+		{name: "loopback range", address: "127.1.2.3:80", denied: true},
+		{name: "ipv6 loopback", address: "[::1]:80", denied: true},
+		{name: "ipv4 mapped loopback", address: "[::ffff:127.0.0.1]:80", denied: true},
+		{name: "metadata endpoint", address: "169.254.169.254:80", denied: true},
+		{name: "private", address: "10.1.2.3:443", denied: true},
+		{name: "carrier grade nat", address: "100.64.0.1:443", denied: true},
+		{name: "this network", address: "0.0.0.0:80", denied: true},
+		{name: "unspecified ipv6", address: "[::]:80", denied: true},
+		{name: "zoned link local", address: "[fe80::1%eth0]:80", denied: true},
+		{name: "unique local", address: "[fd00::1]:443", denied: true},
+		{name: "not an address", address: "example.com:443", denied: true},
+
+		{name: "configured deny", deny: []string{"203.0.113.0/24"}, address: "203.0.113.7:443", denied: true},
+		{name: "configured deny single address", deny: []string{"198.51.100.1"}, address: "198.51.100.1:443", denied: true},
+		{name: "outside configured deny", deny: []string{"203.0.113.0/24"}, address: "203.0.114.7:443"},
+		{name: "allowed inside default deny", allow: []string{"10.20.0.0/16"}, address: "10.20.1.1:443"},
+		{name: "allow is not wider than given", allow: []string{"10.20.0.0/16"}, address: "10.21.1.1:443", denied: true},
+		{name: "allowed loopback address", allow: []string{"127.0.0.1"}, address: "127.0.0.1:8080"},
+		{name: "allowed ipv4 mapped", allow: []string{"127.0.0.1"}, address: "[::ffff:127.0.0.1]:8080"},
+		{name: "denied port", denyPorts: []uint16{25}, address: "93.184.216.34:25", denied: true},
+		{name: "denied port wins over allow", allow: []string{"10.0.0.0/8"}, denyPorts: []uint16{25}, address: "10.0.0.1:25", denied: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := NewPolicy(test.deny, test.allow, test.denyPorts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = policy.Control("tcp", test.address, nil)
+			if test.denied && !errors.Is(err, ErrDenied) {
+				t.Errorf("got %v, want the connection denied", err)
+			}
+			if !test.denied && err != nil {
+				t.Errorf("got %v, want the connection allowed", err)
+			}
+		})
+	}
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	if _, err := NewPolicy([]string{"10.0.0.0/33"}, nil, nil); err == nil {
+		t.Error("invalid deny range accepted")
+	}
+	if _, err := NewPolicy(nil, []string{"not an address"}, nil); err == nil {
+		t.Error("invalid allow address accepted")
+	}
+}
+
+// the check runs on the address dialed, after the hostname is resolved
+func TestDialerControl(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	tests := []struct {
+		name    string
+		allow   []string
+		address string
+		denied  bool
+	}{
+		{name: "address", address: "127.0.0.1:" + port, denied: true},
+		{name: "hostname resolving to loopback", address: "localhost:" + port, denied: true},
+		{name: "allowed", allow: []string{"127.0.0.1"}, address: "127.0.0.1:" + port},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := NewPolicy(nil, test.allow, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dialer := &net.Dialer{Control: policy.Control}
+
+			conn, err := dialer.Dial("tcp4", test.address)
+			if test.denied {
+				if !errors.Is(err, ErrDenied) {
+					t.Errorf("got %v, want the connection denied", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		})
+	}
+}
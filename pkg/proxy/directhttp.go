@@ -18,6 +18,7 @@ package proxy
 */
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -26,14 +27,58 @@ import (
 
 	"github.com/rhysbryant/proxylink/pkg/httputils"
 	"github.com/rhysbryant/proxylink/pkg/ioutils"
+	"github.com/rhysbryant/proxylink/pkg/metrics"
+	"github.com/rhysbryant/proxylink/pkg/netpolicy"
+	"github.com/rhysbryant/proxylink/pkg/udprelay"
 )
 
+// DirectProviderName is reported as the provider for requests made directly
+const DirectProviderName = "DIRECT"
+
 type DirectHTTPProxy struct {
+	dialer    *net.Dialer
+	transport *http.Transport
+	// shared by every plain request so connections to destinations are pooled
+	client *http.Client
+	policy *netpolicy.Policy
 }
 
 func NewDirectHTTPProxy() *DirectHTTPProxy {
-	return &DirectHTTPProxy{}
+	d, _ := NewDirectHTTPProxyWithOptions(DefaultTransportOptions)
+	return d
+}
+
+// NewDirectHTTPProxyWithOptions returns a direct proxy whose connections are tuned by opts,
+// an error is returned if the CA file cannot be loaded
+func NewDirectHTTPProxyWithOptions(opts TransportOptions) (*DirectHTTPProxy, error) {
+	opts = opts.withDefaults()
+	d := &DirectHTTPProxy{dialer: &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: opts.KeepAlive}}
+
+	var err error
+	if d.transport, err = newTransport(opts, d.dialer); err != nil {
+		return nil, err
+	}
+	d.client = &http.Client{
+		// needs to not follow redirects, as we want to return the redirect to the client
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Jar:       nil, // disable storing cookies
+		Transport: d.transport,
+	}
+	return d, nil
+}
 
+// SetDestinationPolicy refuses connections to addresses policy denies, it is checked when dialing
+// so the address a hostname resolves to at that moment is the one checked, nil removes the policy.
+// it must be called before the first request as the dialer is shared with the pooled transport without locking
+func (d *DirectHTTPProxy) SetDestinationPolicy(policy *netpolicy.Policy) {
+	d.policy = policy
+	if policy == nil {
+		d.dialer.Control = nil
+		return
+	}
+	d.dialer.Control = policy.Control
 }
 
 func (d *DirectHTTPProxy) writeHTTPResponse(w io.Writer, status int, message string) error {
@@ -51,6 +96,8 @@ func (d *DirectHTTPProxy) writeHTTPResponse(w io.Writer, status int, message str
 }
 
 func (d *DirectHTTPProxy) ProcessRequest(r *http.Request, w http.ResponseWriter) error {
+	httputils.RequestInfoFromRequest(r).SetProvider(DirectProviderName)
+
 	if r.Method == http.MethodConnect {
 		hijacker, ok := w.(http.Hijacker)
 		if !ok {
@@ -74,8 +121,11 @@ func (d *DirectHTTPProxy) ProcessTunnelRequest(r *http.Request, clientConn io.Re
 	host := httputils.GetTLSHostFromRequest(r)
 
 	// Establish a connection to the target server
-	destConn, err := net.Dial("tcp", host)
-	if err != nil {
+	destConn, err := d.dialer.DialContext(r.Context(), "tcp", host)
+	if errors.Is(err, netpolicy.ErrDenied) {
+		d.writeHTTPResponse(clientConn, http.StatusForbidden, "Forbidden")
+		return fmt.Errorf("failed to connect to target: %w", err)
+	} else if err != nil {
 		d.writeHTTPResponse(clientConn, http.StatusGatewayTimeout, "Service Unavailable")
 		return fmt.Errorf("failed to connect to target: %w", err)
 	}
@@ -85,35 +135,53 @@ func (d *DirectHTTPProxy) ProcessTunnelRequest(r *http.Request, clientConn io.Re
 		return fmt.Errorf("failed to write connection established response: %w", err)
 	}
 
-	return ioutils.ByoDirectionalCopy(destConn, clientConn)
+	return copyTunnel(destConn, clientConn)
+}
+
+var (
+	upstreamBytes   = metrics.BytesTransferred.WithLabelValues("upstream")
+	downstreamBytes = metrics.BytesTransferred.WithLabelValues("downstream")
+)
+
+// copyTunnel relays a tunnel between the client and the destination, bytes are counted in metrics.BytesTransferred
+// as upstream from the client and downstream back
+func copyTunnel(destConn io.ReadWriteCloser, clientConn io.ReadWriteCloser) error {
+	return ioutils.ByoDirectionalCopy(destConn, clientConn,
+		func(n int) { upstreamBytes.Add(float64(n)) },
+		func(n int) { downstreamBytes.Add(float64(n)) })
+}
+
+// DialPacket opens a UDP socket that sends datagrams directly to their destinations
+func (d *DirectHTTPProxy) DialPacket(r *http.Request) (udprelay.Conn, error) {
+	httputils.RequestInfoFromRequest(r).SetProvider(DirectProviderName)
+	return udprelay.ListenDirect(udprelay.DefaultIdleTimeout, d.policy)
 }
 
 // Extract the host from the request
-func (DirectHTTPProxy) ProcessPlainTextRequest(r *http.Request, w http.ResponseWriter) error {
+func (d *DirectHTTPProxy) ProcessPlainTextRequest(r *http.Request, w http.ResponseWriter) error {
 
 	// Create the request to the target URL
 	targetURL := r.URL.String()
 	if !strings.HasPrefix(targetURL, "http") {
-		targetURL = "http://" + r.Host + r.URL.Path
+		targetURL = "http://" + r.Host + r.URL.RequestURI()
 	}
 
-	req, err := http.NewRequest(r.Method, targetURL, r.Body)
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, r.Body)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
 	httputils.CopyRequest(r, req)
 
-	// needs to not follow redirects, as we want to return the redirect to the client
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-		Jar: nil, // disable storing cookies
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
+	resp, err := d.client.Do(req)
+	var netErr net.Error
+	if errors.Is(err, netpolicy.ErrDenied) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return fmt.Errorf("failed to perform request: %w", err)
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		http.Error(w, "The destination server did not respond in time", http.StatusGatewayTimeout)
+		return fmt.Errorf("failed to perform request: %w", err)
+	} else if err != nil {
 		http.Error(w, "Failed to reach the destination server", http.StatusBadGateway)
 		return fmt.Errorf("failed to perform request: %w", err)
 	}
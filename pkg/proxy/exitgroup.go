@@ -0,0 +1,321 @@
+package proxy
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* A group of exit nodes used as a single proxy provider.
+
+requests are sent to the first node chosen by the group's strategy, if the node cannot be reached
+the next one is tried and the failed node is ejected for a while. nodes are health checked by pinging
+them over their websocket session, a successful check brings an ejected node back.
+
+*/
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rhysbryant/proxylink/pkg/httputils"
+	"github.com/rhysbryant/proxylink/pkg/udprelay"
+)
+
+type Strategy string
+
+const (
+	// use nodes in the order they are listed, later nodes are only used when earlier ones are down
+	StrategyFailover Strategy = "failover"
+	// spread requests evenly over the nodes
+	StrategyRoundRobin Strategy = "round-robin"
+	// send requests to the node with the fewest in progress
+	StrategyLeastConnections Strategy = "least-connections"
+	// prefer nodes with a lower round trip time, weighted so slower nodes still get some requests
+	StrategyLatency Strategy = "latency"
+)
+
+const (
+	DefaultHealthCheckInterval = 30 * time.Second
+
+	minEjectTime = 10 * time.Second
+	maxEjectTime = 5 * time.Minute
+	// assumed round trip time for nodes that have not been checked yet
+	unknownLatency = 100 * time.Millisecond
+)
+
+type groupNode struct {
+	client *WSBridgeProxyClient
+	active atomic.Int64
+	// smoothed round trip time in nanoseconds
+	latency atomic.Int64
+
+	mu           sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+}
+
+func (n *groupNode) available() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return time.Now().After(n.ejectedUntil)
+}
+
+// eject takes the node out of rotation, the time doubles with each consecutive failure
+func (n *groupNode) eject() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ejectTime := minEjectTime << min(n.failures, 5)
+	ejectTime = min(ejectTime, maxEjectTime)
+	n.failures++
+	n.ejectedUntil = time.Now().Add(ejectTime)
+	return ejectTime
+}
+
+// restore puts the node back into rotation, it reports if the node had been ejected
+func (n *groupNode) restore() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	wasEjected := n.failures > 0
+	n.failures = 0
+	n.ejectedUntil = time.Time{}
+	return wasEjected
+}
+
+func (n *groupNode) recordLatency(rtt time.Duration) {
+	previous := n.latency.Load()
+	if previous == 0 {
+		n.latency.Store(int64(rtt))
+		return
+	}
+	n.latency.Store((previous*7 + int64(rtt)) / 8)
+}
+
+func (n *groupNode) rtt() time.Duration {
+	if latency := n.latency.Load(); latency > 0 {
+		return time.Duration(latency)
+	}
+	return unknownLatency
+}
+
+type ExitGroup struct {
+	name     string
+	strategy Strategy
+	nodes    []*groupNode
+	next     atomic.Uint64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// NewExitGroup returns a provider that spreads requests over nodes using strategy
+func NewExitGroup(name string, strategy Strategy, nodes []*WSBridgeProxyClient) (*ExitGroup, error) {
+	switch strategy {
+	case "":
+		strategy = StrategyFailover
+	case StrategyFailover, StrategyRoundRobin, StrategyLeastConnections, StrategyLatency:
+	default:
+		return nil, fmt.Errorf("unknown exit group strategy %q", strategy)
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("exit group %s has no nodes", name)
+	}
+
+	g := &ExitGroup{name: name, strategy: strategy, stop: make(chan struct{})}
+	for _, client := range nodes {
+		g.nodes = append(g.nodes, &groupNode{client: client})
+	}
+	return g, nil
+}
+
+// StartHealthChecks pings every node each interval until Close is called
+func (g *ExitGroup) StartHealthChecks(interval time.Duration) {
+	go func() {
+		g.checkNodes()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				g.checkNodes()
+			case <-g.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (g *ExitGroup) checkNodes() {
+	var wg sync.WaitGroup
+	for _, node := range g.nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rtt, err := node.client.Ping()
+			if err != nil {
+				if node.available() {
+					g.ejectNode(node, fmt.Errorf("health check failed: %w", err))
+				}
+				return
+			}
+
+			node.recordLatency(rtt)
+			if node.restore() {
+				slog.Info("exit node restored", "group", g.name, "node", node.client.nextProxyServer, "rtt", rtt)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (g *ExitGroup) ejectNode(node *groupNode, err error) {
+	ejectTime := node.eject()
+	slog.Warn("exit node ejected", "group", g.name, "node", node.client.nextProxyServer, "for", ejectTime, "error", err)
+}
+
+// Close stops the health checks and closes the nodes once their requests finish
+func (g *ExitGroup) Close() error {
+	g.stopOnce.Do(func() {
+		close(g.stop)
+		for _, node := range g.nodes {
+			node.client.Close()
+		}
+	})
+	return nil
+}
+
+// candidates returns the nodes to try in order, ejected nodes are kept at the end as a last resort
+func (g *ExitGroup) candidates() []*groupNode {
+	var available, ejected []*groupNode
+	for _, node := range g.nodes {
+		if node.available() {
+			available = append(available, node)
+		} else {
+			ejected = append(ejected, node)
+		}
+	}
+
+	switch g.strategy {
+	case StrategyRoundRobin:
+		if len(available) > 0 {
+			offset := int(g.next.Add(1) % uint64(len(available)))
+			available = append(available[offset:], available[:offset]...)
+		}
+	case StrategyLeastConnections:
+		slices.SortStableFunc(available, func(a, b *groupNode) int {
+			return int(a.active.Load() - b.active.Load())
+		})
+	case StrategyLatency:
+		available = weightedByLatency(available)
+	}
+
+	return append(available, ejected...)
+}
+
+// weightedByLatency picks the first node at random weighted by the inverse of its round trip time,
+// the rest follow fastest first
+func weightedByLatency(nodes []*groupNode) []*groupNode {
+	if len(nodes) < 2 {
+		return nodes
+	}
+
+	slices.SortStableFunc(nodes, func(a, b *groupNode) int {
+		return int(a.rtt() - b.rtt())
+	})
+
+	total := 0.0
+	for _, node := range nodes {
+		total += 1 / node.rtt().Seconds()
+	}
+
+	pick := rand.Float64() * total
+	for i, node := range nodes {
+		pick -= 1 / node.rtt().Seconds()
+		if pick <= 0 {
+			return append([]*groupNode{node}, slices.Delete(slices.Clone(nodes), i, i+1)...)
+		}
+	}
+	return nodes
+}
+
+// openStream opens a stream on the first node that can be reached
+func (g *ExitGroup) openStream() (*groupNode, io.ReadWriteCloser, *http.Response, error) {
+	var resp *http.Response
+	var err error
+	for _, node := range g.candidates() {
+		var stream io.ReadWriteCloser
+		stream, resp, err = node.client.openStream()
+		if err == nil {
+			return node, stream, nil, nil
+		}
+		g.ejectNode(node, err)
+	}
+	return nil, nil, resp, err
+}
+
+func (g *ExitGroup) ProcessRequest(r *http.Request, w http.ResponseWriter) error {
+	httputils.RequestInfoFromRequest(r).SetProvider("group:" + g.name)
+	node, destConn, resp, err := g.openStream()
+	if err != nil {
+		return writeDialError(w, resp, err)
+	}
+
+	node.active.Add(1)
+	defer node.active.Add(-1)
+
+	return node.client.processOnStream(r, w, destConn)
+}
+
+// DialPacket opens a UDP association through the first node that can be reached
+func (g *ExitGroup) DialPacket(r *http.Request) (udprelay.Conn, error) {
+	httputils.RequestInfoFromRequest(r).SetProvider("group:" + g.name)
+	node, destConn, _, err := g.openStream()
+	if err != nil {
+		return nil, fmt.Errorf("no exit node in group %s could be reached: %w", g.name, err)
+	}
+
+	conn, err := dialPacketOnStream(r, destConn)
+	if err != nil {
+		return nil, err
+	}
+
+	node.active.Add(1)
+	return &groupPacketConn{Conn: conn, node: node}, nil
+}
+
+// groupPacketConn counts a UDP association as a connection to its node until it is closed
+type groupPacketConn struct {
+	udprelay.Conn
+	node      *groupNode
+	closeOnce sync.Once
+}
+
+func (c *groupPacketConn) Close() error {
+	c.closeOnce.Do(func() { c.node.active.Add(-1) })
+	return c.Conn.Close()
+}
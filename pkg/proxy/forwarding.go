@@ -0,0 +1,152 @@
+package proxy
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rhysbryant/proxylink/pkg/httputils"
+	"github.com/rhysbryant/proxylink/pkg/udprelay"
+)
+
+// ForwardingMode is how a proxy header describing the client or the proxies a request passed through is handled
+type ForwardingMode string
+
+const (
+	// add this proxy to the header
+	ForwardingOn ForwardingMode = "on"
+	// pass the header on as it was received
+	ForwardingOff ForwardingMode = "off"
+	// remove the header so nothing about the client or earlier proxies reaches the destination
+	ForwardingAnonymise ForwardingMode = "anonymise"
+)
+
+// DefaultPseudonym is the name added to Via when none is configured
+const DefaultPseudonym = "proxylink"
+
+// forwardedForHeaders identify the client, X-Real-IP is not added but is removed when anonymising
+var forwardedForHeaders = []string{"X-Forwarded-For", "Forwarded", "X-Real-Ip"}
+
+type ForwardingPolicy struct {
+	Via          ForwardingMode // the Via header
+	ForwardedFor ForwardingMode // the X-Forwarded-For and Forwarded headers
+	Pseudonym    string         // name this proxy is added to Via with
+}
+
+// ForwardingWrapper applies a ForwardingPolicy to plain requests before passing them on,
+// tunnels are passed on unchanged as the headers of the requests inside them cannot be seen
+type ForwardingWrapper struct {
+	next   httputils.RequestProcessor
+	policy ForwardingPolicy
+}
+
+func validForwardingMode(mode ForwardingMode) bool {
+	return mode == ForwardingOn || mode == ForwardingOff || mode == ForwardingAnonymise
+}
+
+// NewForwardingWrapper returns a wrapper applying policy to requests for next, unset modes are off
+func NewForwardingWrapper(next httputils.RequestProcessor, policy ForwardingPolicy) (*ForwardingWrapper, error) {
+	if policy.Via == "" {
+		policy.Via = ForwardingOff
+	}
+	if policy.ForwardedFor == "" {
+		policy.ForwardedFor = ForwardingOff
+	}
+	if !validForwardingMode(policy.Via) {
+		return nil, fmt.Errorf("unknown via mode %q", policy.Via)
+	}
+	if !validForwardingMode(policy.ForwardedFor) {
+		return nil, fmt.Errorf("unknown forwardedFor mode %q", policy.ForwardedFor)
+	}
+	if policy.Pseudonym == "" {
+		policy.Pseudonym = DefaultPseudonym
+	}
+	return &ForwardingWrapper{next: next, policy: policy}, nil
+}
+
+func (fw *ForwardingWrapper) ProcessRequest(r *http.Request, w http.ResponseWriter) error {
+	if r.Method != http.MethodConnect {
+		r.Header = r.Header.Clone()
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		fw.applyVia(r)
+		fw.applyForwardedFor(r)
+	}
+	return fw.next.ProcessRequest(r, w)
+}
+
+// DialPacket passes UDP associations on, they carry no headers
+func (fw *ForwardingWrapper) DialPacket(r *http.Request) (udprelay.Conn, error) {
+	dialer, ok := fw.next.(udprelay.Dialer)
+	if !ok {
+		return nil, errors.New("udp relay not supported")
+	}
+	return dialer.DialPacket(r)
+}
+
+func (fw *ForwardingWrapper) applyVia(r *http.Request) {
+	switch fw.policy.Via {
+	case ForwardingOn:
+		protocol := fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+		if r.ProtoMajor == 0 {
+			protocol = "1.1"
+		}
+		appendHeader(r.Header, "Via", protocol+" "+fw.policy.Pseudonym)
+	case ForwardingAnonymise:
+		r.Header.Del("Via")
+	}
+}
+
+func (fw *ForwardingWrapper) applyForwardedFor(r *http.Request) {
+	switch fw.policy.ForwardedFor {
+	case ForwardingOn:
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		appendHeader(r.Header, "X-Forwarded-For", client)
+
+		// RFC 7239, IPv6 addresses are quoted and bracketed
+		node := client
+		if strings.Contains(client, ":") {
+			node = `"[` + client + `]"`
+		}
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		appendHeader(r.Header, "Forwarded", "for="+node+";proto="+proto)
+	case ForwardingAnonymise:
+		for _, name := range forwardedForHeaders {
+			r.Header.Del(name)
+		}
+	}
+}
+
+// appendHeader adds value to the comma separated list in the header name
+func appendHeader(header http.Header, name, value string) {
+	if previous := header.Values(name); len(previous) > 0 {
+		value = strings.Join(previous, ", ") + ", " + value
+	}
+	header.Set(name, value)
+}
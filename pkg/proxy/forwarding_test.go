@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// recordingProcessor keeps the request passed to it
+type recordingProcessor struct {
+	request *http.Request
+}
+
+func (p *recordingProcessor) ProcessRequest(r *http.Request, w http.ResponseWriter) error {
+	p.request = r
+	return nil
+}
+
+func TestForwardingWrapper(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     ForwardingPolicy
+		method     string
+		remoteAddr string
+		header     http.Header
+		want       http.Header
+	}{
+		{
+			name:       "off passes headers on",
+			policy:     ForwardingPolicy{},
+			remoteAddr: "192.0.2.1:5000",
+			header:     http.Header{"Via": {"1.1 upstream"}, "X-Forwarded-For": {"198.51.100.1"}},
+			want:       http.Header{"Via": {"1.1 upstream"}, "X-Forwarded-For": {"198.51.100.1"}},
+		},
+		{
+			name:       "on adds this proxy",
+			policy:     ForwardingPolicy{Via: ForwardingOn, ForwardedFor: ForwardingOn},
+			remoteAddr: "192.0.2.1:5000",
+			header:     http.Header{},
+			want: http.Header{
+				"Via":             {"1.1 proxylink"},
+				"X-Forwarded-For": {"192.0.2.1"},
+				"Forwarded":       {"for=192.0.2.1;proto=http"},
+			},
+		},
+		{
+			name:       "on appends to existing headers",
+			policy:     ForwardingPolicy{Via: ForwardingOn, ForwardedFor: ForwardingOn, Pseudonym: "edge"},
+			remoteAddr: "192.0.2.1:5000",
+			header: http.Header{
+				"Via":             {"1.0 first", "1.1 second"},
+				"X-Forwarded-For": {"198.51.100.1, 198.51.100.2"},
+				"Forwarded":       {"for=198.51.100.1"},
+			},
+			want: http.Header{
+				"Via":             {"1.0 first, 1.1 second, 1.1 edge"},
+				"X-Forwarded-For": {"198.51.100.1, 198.51.100.2, 192.0.2.1"},
+				"Forwarded":       {"for=198.51.100.1, for=192.0.2.1;proto=http"},
+			},
+		},
+		{
+			name:       "ipv6 forwarded node is quoted",
+			policy:     ForwardingPolicy{ForwardedFor: ForwardingOn},
+			remoteAddr: "[2001:db8::1]:5000",
+			header:     http.Header{},
+			want: http.Header{
+				"X-Forwarded-For": {"2001:db8::1"},
+				"Forwarded":       {`for="[2001:db8::1]";proto=http`},
+			},
+		},
+		{
+			name:       "anonymise removes client headers",
+			policy:     ForwardingPolicy{Via: ForwardingAnonymise, ForwardedFor: ForwardingAnonymise},
+			remoteAddr: "192.0.2.1:5000",
+			header: http.Header{
+				"Via":             {"1.1 upstream"},
+				"X-Forwarded-For": {"198.51.100.1"},
+				"Forwarded":       {"for=198.51.100.1"},
+				"X-Real-Ip":       {"198.51.100.1"},
+				"Accept":          {"*/*"},
+			},
+			want: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name:       "tunnels are unchanged",
+			policy:     ForwardingPolicy{Via: ForwardingOn, ForwardedFor: ForwardingAnonymise},
+			method:     http.MethodConnect,
+			remoteAddr: "192.0.2.1:5000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := &recordingProcessor{}
+			wrapper, err := NewForwardingWrapper(next, test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r, err := http.NewRequest(method, "http://example.com/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.RemoteAddr = test.remoteAddr
+			r.Header = test.header.Clone()
+
+			if err := wrapper.ProcessRequest(r, nil); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(next.request.Header, test.want) {
+				t.Errorf("got headers %v want %v", next.request.Header, test.want)
+			}
+		})
+	}
+}
+
+func TestForwardingWrapperUnknownMode(t *testing.T) {
+	if _, err := NewForwardingWrapper(&recordingProcessor{}, ForwardingPolicy{Via: "sometimes"}); err == nil {
+		t.Error("unknown via mode accepted")
+	}
+	if _, err := NewForwardingWrapper(&recordingProcessor{}, ForwardingPolicy{ForwardedFor: "sometimes"}); err == nil {
+		t.Error("unknown forwardedFor mode accepted")
+	}
+}
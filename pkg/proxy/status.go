@@ -0,0 +1,86 @@
+package proxy
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import "time"
+
+// ExitNodeStatus describes the health of an exit node as seen by this proxy
+type ExitNodeStatus struct {
+	URL          string     `json:"url"`
+	Group        string     `json:"group,omitempty"`
+	Via          string     `json:"via,omitempty"` // url of the node this one is reached through
+	Available    bool       `json:"available"`
+	Failures     int        `json:"failures,omitempty"` // consecutive failed health checks
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+	LatencyMs    float64    `json:"latencyMs,omitempty"`
+	Active       int64      `json:"activeRequests,omitempty"`
+	Sessions     int        `json:"sessions"`
+	Streams      int        `json:"streams"`
+	LastError    string     `json:"lastError,omitempty"`
+}
+
+// Status reports the sessions open to the next proxy, followed by the status of the nodes it is reached through.
+// the node is considered available unless the last attempt to connect failed
+func (b *WSBridgeProxyClient) Status() []ExitNodeStatus {
+	b.sessionsMu.Lock()
+	status := ExitNodeStatus{URL: b.nextProxyServer, Available: b.lastDialErr == nil}
+	if b.lastDialErr != nil {
+		status.LastError = b.lastDialErr.Error()
+	}
+	for _, session := range b.sessions {
+		if session.IsClosed() {
+			continue
+		}
+		status.Sessions++
+		status.Streams += session.NumStreams()
+	}
+	b.sessionsMu.Unlock()
+
+	if b.via == nil {
+		return []ExitNodeStatus{status}
+	}
+	status.Via = b.via.nextProxyServer
+	return append([]ExitNodeStatus{status}, b.via.Status()...)
+}
+
+// Status reports the health of each node in the group
+func (g *ExitGroup) Status() []ExitNodeStatus {
+	var statuses []ExitNodeStatus
+	for _, node := range g.nodes {
+		nodeStatuses := node.client.Status()
+		status := &nodeStatuses[0]
+		status.Group = g.name
+		status.Active = node.active.Load()
+		if latency := node.latency.Load(); latency > 0 {
+			status.LatencyMs = float64(latency) / float64(time.Millisecond)
+		}
+
+		// the health checks decide whether a node in a group is used
+		node.mu.Lock()
+		status.Failures = node.failures
+		status.Available = !time.Now().Before(node.ejectedUntil)
+		if !status.Available {
+			ejectedUntil := node.ejectedUntil
+			status.EjectedUntil = &ejectedUntil
+		}
+		node.mu.Unlock()
+
+		statuses = append(statuses, nodeStatuses...)
+	}
+	return statuses
+}
@@ -0,0 +1,108 @@
+package proxy
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// TransportOptions tune the connections DirectHTTPProxy makes to destinations, zero values use DefaultTransportOptions
+type TransportOptions struct {
+	DialTimeout           time.Duration `yaml:"dialTimeout,omitempty"`           // connecting, including tunnels
+	KeepAlive             time.Duration `yaml:"keepAlive,omitempty"`             // interval between TCP keep-alive probes
+	TLSHandshakeTimeout   time.Duration `yaml:"tlsHandshakeTimeout,omitempty"`   // for https destinations of plain requests
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout,omitempty"` // waiting for a destination to start its response
+	IdleConnTimeout       time.Duration `yaml:"idleConnTimeout,omitempty"`       // idle pooled connections are closed after this long
+	MaxIdleConns          int           `yaml:"maxIdleConns,omitempty"`          // idle connections pooled across all hosts
+	MaxIdleConnsPerHost   int           `yaml:"maxIdleConnsPerHost,omitempty"`   // idle connections pooled for each host
+	MaxConnsPerHost       int           `yaml:"maxConnsPerHost,omitempty"`       // connections to each host, 0 for no limit
+	DisableKeepAlives     bool          `yaml:"disableKeepAlives,omitempty"`     // use a new connection for every request
+	HTTP2                 bool          `yaml:"http2,omitempty"`                 // use HTTP/2 with https destinations that support it
+	InsecureSkipVerify    bool          `yaml:"insecureSkipVerify,omitempty"`    // do not verify the certificates of https destinations
+	CAFile                string        `yaml:"caFile,omitempty"`                // PEM certificates trusted in place of the system roots
+}
+
+// DefaultTransportOptions are used for the options that are not set
+var DefaultTransportOptions = TransportOptions{
+	DialTimeout:           30 * time.Second,
+	KeepAlive:             30 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 60 * time.Second,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   16,
+}
+
+func (o TransportOptions) withDefaults() TransportOptions {
+	setDefault := func(value *time.Duration, defaultValue time.Duration) {
+		if *value == 0 {
+			*value = defaultValue
+		}
+	}
+	setDefault(&o.DialTimeout, DefaultTransportOptions.DialTimeout)
+	setDefault(&o.KeepAlive, DefaultTransportOptions.KeepAlive)
+	setDefault(&o.TLSHandshakeTimeout, DefaultTransportOptions.TLSHandshakeTimeout)
+	setDefault(&o.ResponseHeaderTimeout, DefaultTransportOptions.ResponseHeaderTimeout)
+	setDefault(&o.IdleConnTimeout, DefaultTransportOptions.IdleConnTimeout)
+	if o.MaxIdleConns == 0 {
+		o.MaxIdleConns = DefaultTransportOptions.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost == 0 {
+		o.MaxIdleConnsPerHost = DefaultTransportOptions.MaxIdleConnsPerHost
+	}
+	return o
+}
+
+// newTransport builds the pooled transport shared by every plain request, dialer is used for its connections
+func newTransport(opts TransportOptions, dialer *net.Dialer) (*http.Transport, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", opts.CAFile)
+		}
+	}
+
+	return &http.Transport{
+		// requests go straight to the destination, a proxy from the environment would skip the destination policy
+		// checked when dialing
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		DisableKeepAlives:     opts.DisableKeepAlives,
+		ExpectContinueTimeout: time.Second,
+		// a transport with its own dialer or TLS config only speaks HTTP/2 when asked to
+		ForceAttemptHTTP2: opts.HTTP2,
+	}, nil
+}
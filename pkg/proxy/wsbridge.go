@@ -23,59 +23,367 @@ package proxy
 
 raw HHTTP 1.1 requests are sent over the WebSocket connection to the next proxy server, which processes them and sends back the responses.
 
+each request is carried on its own stream multiplexed over a small pool of long lived WebSocket sessions.
+
 */
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/rhysbryant/proxylink/pkg/httputils"
 	"github.com/rhysbryant/proxylink/pkg/ioutils"
+	"github.com/rhysbryant/proxylink/pkg/keyring"
+	"github.com/rhysbryant/proxylink/pkg/metrics"
+	"github.com/rhysbryant/proxylink/pkg/mux"
+	"github.com/rhysbryant/proxylink/pkg/udprelay"
 	"github.com/rhysbryant/proxylink/pkg/wswrapper"
 )
 
+const (
+	// maximum number of websocket sessions kept open to the next proxy
+	defaultMaxSessions = 4
+	// number of concurrent streams on a session before another session is dialed
+	defaultMaxStreamsPerSession = 128
+	// time allowed to connect to the next proxy, and then to complete the websocket handshake
+	dialTimeout      = 10 * time.Second
+	handshakeTimeout = 10 * time.Second
+)
+
 type WSBridgeProxyClient struct {
 	nextProxyServer string
 	key             []byte
+
+	maxSessions          int
+	maxStreamsPerSession int
+	// refuse next proxies that do not support the key exchange instead of using the pre-shared key directly
+	requireHandshake bool
+
+	// dialContext replaces the network dial to the next proxy, used to reach it through another hop
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	via         *WSBridgeProxyClient
+
+	sessionsMu sync.Mutex
+	sessions   []*mux.Session
+	// error of the last failed dial, cleared by a successful one
+	lastDialErr error
+	// session being dialed, nil when there is no dial in flight
+	dialing *sessionDial
+}
+
+// sessionDial is a dial of a new session that other requests wait on, the results are set before done is closed
+type sessionDial struct {
+	done    chan struct{}
+	session *mux.Session // nil if the dial failed or the next proxy does not multiplex
+	resp    *http.Response
+	err     error
 }
 
 func NewWSBridgeProxyClient(nextProxyAddress string, key []byte) *WSBridgeProxyClient {
-	return &WSBridgeProxyClient{nextProxyServer: nextProxyAddress, key: key}
+	return &WSBridgeProxyClient{
+		nextProxyServer:      nextProxyAddress,
+		key:                  key,
+		maxSessions:          defaultMaxSessions,
+		maxStreamsPerSession: defaultMaxStreamsPerSession,
+		requireHandshake:     true,
+	}
 }
 
-func (b *WSBridgeProxyClient) ProcessRequest(r *http.Request, w http.ResponseWriter) error {
+// Close stops using the client, sessions to the next proxy are closed once their open streams finish
+func (b *WSBridgeProxyClient) Close() error {
+	b.sessionsMu.Lock()
+	sessions := b.sessions
+	b.sessions = nil
+	b.sessionsMu.Unlock()
 
-	nextProxyConn, resp, err := websocket.DefaultDialer.Dial(b.nextProxyServer, nil)
+	for _, session := range sessions {
+		session.CloseWhenIdle()
+	}
+
+	if b.via != nil {
+		return b.via.Close()
+	}
+	return nil
+}
+
+// SetRequireHandshake sets whether next proxies that do not support the key exchange are refused, which is the default.
+// the exchange is agreed with a header that anyone on the path could strip, so allowing the fallback lets them downgrade
+// the connection to the pre-shared key
+func (b *WSBridgeProxyClient) SetRequireHandshake(required bool) {
+	b.requireHandshake = required
+}
+
+// SetVia reaches the next proxy through a tunnel over via, via is closed along with this client
+func (b *WSBridgeProxyClient) SetVia(via *WSBridgeProxyClient) {
+	b.via = via
+	b.SetDialContext(via.DialContext)
+}
+
+// SetDialContext makes connections to the next proxy with dial instead of the network,
+// pass the DialContext of another WSBridgeProxyClient to reach the next proxy through that one
+func (b *WSBridgeProxyClient) SetDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	b.dialContext = dial
+}
+
+// DialContext opens a tunnel to addr through the next proxy with a CONNECT request
+func (b *WSBridgeProxyClient) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	stream, _, err := b.openStream()
 	if err != nil {
-		if err == websocket.ErrBadHandshake {
-			if resp.StatusCode == http.StatusProxyAuthRequired {
-				http.Error(w, resp.Status, http.StatusProxyAuthRequired)
-				return fmt.Errorf("proxy authentication required")
+		return nil, fmt.Errorf("failed to connect to websocket proxy: %w", err)
+	}
+
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+	r = r.WithContext(ctx)
+
+	if err := r.Write(stream); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("failed to write request to websocket proxy: %w", err)
+	}
+
+	reader := bufio.NewReader(stream)
+	resp, err := http.ReadResponse(reader, r)
+	if err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("failed to read response from websocket proxy: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		stream.Close()
+		return nil, fmt.Errorf("tunnel to %s refused by next proxy: %s", addr, resp.Status)
+	}
+
+	return ioutils.NewConn(ioutils.NewBufferedReadWriteCloser(stream, reader)), nil
+}
+
+// dial opens a new websocket connection to the next proxy, multiplexed reports if the next proxy agreed to multiplex streams
+func (b *WSBridgeProxyClient) dial() (conn io.ReadWriteCloser, multiplexed bool, resp *http.Response, err error) {
+	netDial := b.dialContext
+	if netDial == nil {
+		netDial = (&net.Dialer{}).DialContext
+	}
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: handshakeTimeout,
+		Subprotocols:     mux.Protocols,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			return netDial(ctx, network, addr)
+		},
+	}
+
+	header := http.Header{}
+	if b.key != nil {
+		header.Set(wswrapper.KeyIDHeader, keyring.Fingerprint(b.key))
+		header.Set(wswrapper.HandshakeHeader, wswrapper.HandshakeX25519PSK)
+	}
+
+	nextProxyConn, resp, err := dialer.Dial(b.nextProxyServer, header)
+	if err != nil {
+		metrics.ExitNodeDialFailures.WithLabelValues(b.nextProxyServer).Inc()
+		return nil, false, resp, err
+	}
+
+	switch {
+	case b.key != nil && resp.Header.Get(wswrapper.HandshakeHeader) == wswrapper.HandshakeX25519PSK:
+		conn, err = wswrapper.NewWSConnWithHandshake(nextProxyConn, [32]byte(b.key), true)
+		if err != nil {
+			metrics.ExitNodeDialFailures.WithLabelValues(b.nextProxyServer).Inc()
+			return nil, false, resp, fmt.Errorf("handshake with next proxy failed: %w", err)
+		}
+	case b.key != nil && b.requireHandshake:
+		nextProxyConn.Close()
+		metrics.ExitNodeDialFailures.WithLabelValues(b.nextProxyServer).Inc()
+		return nil, false, resp, errors.New("next proxy does not support the key exchange")
+	case b.key != nil:
+		// exit nodes from before the key exchange was added use the pre-shared key directly
+		slog.Warn("next proxy does not support the key exchange, falling back to the pre-shared key", "url", b.nextProxyServer)
+		conn = wswrapper.NewWSConnWithEncryption(nextProxyConn, [32]byte(b.key), true)
+	default:
+		conn = wswrapper.NewWSConn(nextProxyConn)
+	}
+
+	return conn, mux.IsProtocol(nextProxyConn.Subprotocol()), resp, nil
+}
+
+// dialAndRecord dials the next proxy and records the outcome for Status
+func (b *WSBridgeProxyClient) dialAndRecord() (io.ReadWriteCloser, bool, *http.Response, error) {
+	conn, multiplexed, resp, err := b.dial()
+
+	b.sessionsMu.Lock()
+	b.lastDialErr = err
+	b.sessionsMu.Unlock()
+	return conn, multiplexed, resp, err
+}
+
+// dialSession dials a new session to the next proxy, callers arriving while a dial is in flight wait for it and share
+// its session instead of dialing their own. sessionsMu is not held while dialing so a slow next proxy does not block
+// requests that can use the sessions already open.
+// if the next proxy does not support multiplexing a connection for the caller alone is returned instead of a session
+func (b *WSBridgeProxyClient) dialSession() (*mux.Session, io.ReadWriteCloser, *http.Response, error) {
+	b.sessionsMu.Lock()
+	if call := b.dialing; call != nil {
+		b.sessionsMu.Unlock()
+		<-call.done
+		if call.err != nil || call.session != nil {
+			return call.session, nil, call.resp, call.err
+		}
+		// the connection dialed is not shared, each request needs its own
+		conn, _, resp, err := b.dialAndRecord()
+		return nil, conn, resp, err
+	}
+	call := &sessionDial{done: make(chan struct{})}
+	b.dialing = call
+	b.sessionsMu.Unlock()
+
+	conn, multiplexed, resp, err := b.dial()
+
+	b.sessionsMu.Lock()
+	b.dialing = nil
+	b.lastDialErr = err
+	if err == nil && multiplexed {
+		call.session = mux.NewClientSession(conn)
+		b.sessions = append(b.sessions, call.session)
+		conn = nil
+	}
+	b.sessionsMu.Unlock()
+
+	call.resp = resp
+	call.err = err
+	close(call.done)
+	return call.session, conn, resp, err
+}
+
+// openStream returns a connection to the next proxy for a single request.
+// streams are opened on an existing session when one has capacity, otherwise a new session is dialed.
+// if the next proxy does not support multiplexing the websocket connection itself is returned
+func (b *WSBridgeProxyClient) openStream() (io.ReadWriteCloser, *http.Response, error) {
+	b.sessionsMu.Lock()
+	// pick the least busy session that is still open, draining sessions close by themselves once idle
+	var best *mux.Session
+	bestStreams := 0
+	open := b.sessions[:0]
+	for _, session := range b.sessions {
+		if session.IsDraining() {
+			continue
+		}
+		open = append(open, session)
+
+		if streams := session.NumStreams(); best == nil || streams < bestStreams {
+			best = session
+			bestStreams = streams
+		}
+	}
+	b.sessions = open
+	needSession := best == nil || (bestStreams >= b.maxStreamsPerSession && len(b.sessions) < b.maxSessions)
+	b.sessionsMu.Unlock()
+
+	if needSession {
+		session, conn, resp, err := b.dialSession()
+		switch {
+		case err != nil:
+			if best == nil {
+				return nil, resp, err
 			}
+			// fall back to the busy session we already have
+		case session == nil:
+			return conn, nil, nil
+		default:
+			best = session
 		}
-		http.Error(w, "failed to connect to next proxy", http.StatusBadGateway)
-		return fmt.Errorf("failed to connect to websocket proxy: %w", err)
 	}
 
-	var destConn io.ReadWriteCloser
-	if b.key != nil {
+	stream, err := best.OpenStream()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	return stream, nil, nil
+}
 
-		destConn = wswrapper.NewWSConnWithEncryption(nextProxyConn, [32]byte(b.key), true)
-	} else {
-		destConn = wswrapper.NewWSConn(nextProxyConn)
+// Ping measures the round trip time to the next proxy, a session is dialed if none are open.
+// next proxies that do not support multiplexing report the time taken to connect
+func (b *WSBridgeProxyClient) Ping() (time.Duration, error) {
+	b.sessionsMu.Lock()
+	var session *mux.Session
+	for _, s := range b.sessions {
+		if !s.IsDraining() {
+			session = s
+			break
+		}
 	}
+	b.sessionsMu.Unlock()
+
+	if session == nil {
+		start := time.Now()
+		dialed, conn, _, err := b.dialSession()
+		if err != nil {
+			return 0, err
+		}
+		if dialed == nil {
+			conn.Close()
+			return time.Since(start), nil
+		}
+		session = dialed
+	}
+
+	return session.Ping()
+}
+
+func (b *WSBridgeProxyClient) ProcessRequest(r *http.Request, w http.ResponseWriter) error {
+	httputils.RequestInfoFromRequest(r).SetProvider(b.nextProxyServer)
 
+	destConn, resp, err := b.openStream()
+	if err != nil {
+		return writeDialError(w, resp, err)
+	}
+
+	return b.processOnStream(r, w, destConn)
+}
+
+// writeDialError reports a failure to reach the next proxy to the client
+func writeDialError(w http.ResponseWriter, resp *http.Response, err error) error {
+	if err == websocket.ErrBadHandshake {
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			http.Error(w, resp.Status, http.StatusProxyAuthRequired)
+			return fmt.Errorf("proxy authentication required")
+		}
+	}
+	http.Error(w, "failed to connect to next proxy", http.StatusBadGateway)
+	return fmt.Errorf("failed to connect to websocket proxy: %w", err)
+}
+
+// processOnStream sends r to the next proxy over destConn and relays the response
+func (b *WSBridgeProxyClient) processOnStream(r *http.Request, w http.ResponseWriter, destConn io.ReadWriteCloser) error {
 	defer destConn.Close()
 
-	//write the original http request to the websocket connection
-	if err := r.Write(destConn); err != nil {
+	// the stream to the next proxy is a new hop, headers meant for this one are not sent on
+	httputils.RemoveHopByHopHeaders(r.Header)
+
+	// write the original http request to the websocket connection, in absolute form so the scheme
+	// of decrypted https requests and the query are kept
+	if err := r.WriteProxy(destConn); err != nil {
 		return fmt.Errorf("failed to write request to websocket proxy: %w", err)
 	}
 
 	//read back the response from the websocket connection
-	wsProxiedResponse, err := http.ReadResponse(bufio.NewReader(destConn), r)
+	reader := bufio.NewReader(destConn)
+	wsProxiedResponse, err := http.ReadResponse(reader, r)
 	if err != nil {
 		http.Error(w, "invalid response from next proxy", http.StatusBadGateway)
 		return fmt.Errorf("failed to read response from websocket proxy: %w", err)
@@ -97,7 +405,8 @@ func (b *WSBridgeProxyClient) ProcessRequest(r *http.Request, w http.ResponseWri
 		}
 		defer clientConn.Close()
 
-		if err := ioutils.ByoDirectionalCopy(destConn, clientConn); err != nil {
+		// the reader may already hold tunnel data sent straight after the response, such as an SSH banner
+		if err := copyTunnel(ioutils.NewBufferedReadWriteCloser(destConn, reader), clientConn); err != nil {
 			return fmt.Errorf("failed to copy data between client and websocket proxy: %w", err)
 		}
 	} else {
@@ -110,3 +419,35 @@ func (b *WSBridgeProxyClient) ProcessRequest(r *http.Request, w http.ResponseWri
 
 	return nil
 }
+
+// DialPacket asks the next proxy for a UDP association, datagrams are framed over a stream of the websocket session
+func (b *WSBridgeProxyClient) DialPacket(r *http.Request) (udprelay.Conn, error) {
+	httputils.RequestInfoFromRequest(r).SetProvider(b.nextProxyServer)
+	destConn, _, err := b.openStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to websocket proxy: %w", err)
+	}
+
+	return dialPacketOnStream(r, destConn)
+}
+
+func dialPacketOnStream(r *http.Request, destConn io.ReadWriteCloser) (udprelay.Conn, error) {
+	if err := r.Write(destConn); err != nil {
+		destConn.Close()
+		return nil, fmt.Errorf("failed to write request to websocket proxy: %w", err)
+	}
+
+	reader := bufio.NewReader(destConn)
+	resp, err := http.ReadResponse(reader, r)
+	if err != nil {
+		destConn.Close()
+		return nil, fmt.Errorf("failed to read response from websocket proxy: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		destConn.Close()
+		return nil, fmt.Errorf("udp association refused by next proxy: %s", resp.Status)
+	}
+
+	return udprelay.NewStreamConn(ioutils.NewBufferedReadWriteCloser(destConn, reader)), nil
+}
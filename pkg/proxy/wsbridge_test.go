@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/rhysbryant/proxylink/pkg/wswrapper"
+)
+
+var testKey, _ = hex.DecodeString("0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9")
+
+// newTestExitNode starts an exit node that echoes what it reads, handshake sets whether it supports the key exchange
+func newTestExitNode(t *testing.T, handshake bool) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agreed := handshake && r.Header.Get(wswrapper.HandshakeHeader) == wswrapper.HandshakeX25519PSK
+		header := http.Header{}
+		if agreed {
+			header.Set(wswrapper.HandshakeHeader, wswrapper.HandshakeX25519PSK)
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+
+		var rw io.ReadWriteCloser
+		if agreed {
+			if rw, err = wswrapper.NewWSConnWithHandshake(conn, [32]byte(testKey), false); err != nil {
+				return
+			}
+		} else {
+			rw = wswrapper.NewWSConnWithEncryption(conn, [32]byte(testKey), false)
+		}
+		defer rw.Close()
+		io.Copy(rw, rw)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestDialHandshake(t *testing.T) {
+	tests := []struct {
+		name             string
+		exitHandshake    bool
+		requireHandshake bool
+		wantErr          bool
+	}{
+		{name: "key exchange", exitHandshake: true, requireHandshake: true},
+		{name: "key exchange when not required", exitHandshake: true, requireHandshake: false},
+		{name: "downgrade refused", exitHandshake: false, requireHandshake: true, wantErr: true},
+		{name: "fallback allowed", exitHandshake: false, requireHandshake: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewWSBridgeProxyClient(newTestExitNode(t, test.exitHandshake), testKey)
+			b.SetRequireHandshake(test.requireHandshake)
+
+			conn, _, _, err := b.dial()
+			if test.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("dial succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			message := []byte("hello exit node")
+			if _, err := conn.Write(message); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(message))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(message) {
+				t.Errorf("got %q want %q", got, message)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package requestlogging
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rhysbryant/proxylink/pkg/accesslog"
+)
+
+// SetAccessLog writes an entry to log for each request, tunnel and UDP association once it finishes.
+// the line logged for each request by the operational log moves to the debug level. it is meant to be called before requests are processed
+func (rtw *RequestTrackingWrapper) SetAccessLog(log *accesslog.Logger) {
+	rtw.accessLog = log
+}
+
+// requestLogLevel is the level of the line the operational log writes for each request
+func (rtw *RequestTrackingWrapper) requestLogLevel() slog.Level {
+	if rtw.accessLog != nil {
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+func (rtw *RequestTrackingWrapper) logAccess(r *http.Request, c *connection, status int, err error) {
+	if rtw.accessLog == nil {
+		return
+	}
+
+	client := c.client
+	if host, _, splitErr := net.SplitHostPort(client); splitErr == nil {
+		client = host
+	}
+	url := c.destination
+	if c.kind() == KindRequest && r.URL != nil {
+		// requests tunneled by a bridge only carry the path
+		target := *r.URL
+		if target.Host == "" {
+			target.Host = c.destination
+		}
+		if target.Scheme == "" {
+			target.Scheme = "http"
+		}
+		url = target.String()
+	}
+
+	entry := accesslog.Entry{
+		Time:          c.started,
+		Client:        client,
+		User:          c.user,
+		Kind:          c.kind(),
+		Method:        c.method,
+		URL:           url,
+		Proto:         r.Proto,
+		Status:        status,
+		BytesSent:     c.downstream.Load(),
+		BytesReceived: c.upstream.Load(),
+		Duration:      time.Since(c.started),
+		Rule:          c.info.Rule(),
+		Provider:      c.info.Provider(),
+		Referer:       r.Referer(),
+		UserAgent:     r.UserAgent(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	if err := rtw.accessLog.Log(entry); err != nil {
+		slog.Error("failed to write access log", "error", err)
+	}
+}
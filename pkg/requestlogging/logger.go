@@ -17,20 +17,33 @@ package requestlogging
  along with this program. If not, see <https://www.gnu.org/licenses/>.
 */
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"net"
 	"net/http"
 	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/rhysbryant/proxylink/pkg/accesslog"
 	"github.com/rhysbryant/proxylink/pkg/httputils"
+	"github.com/rhysbryant/proxylink/pkg/metrics"
+	"github.com/rhysbryant/proxylink/pkg/udprelay"
 )
 
+var (
+	activeRequests     = metrics.ActiveConnections.WithLabelValues("request")
+	activeAssociations = metrics.ActiveConnections.WithLabelValues("udp")
+)
+
+// how often Drain checks whether the requests in progress have finished
+const drainPollInterval = 100 * time.Millisecond
+
 type RequestTrackingWrapper struct {
-	next                  httputils.RequestProcessor
-	inProgressConnections atomic.Int64
-	hostnameCache         sync.Map // Cache for reverse DNS lookups
+	next          httputils.RequestProcessor
+	connections   registry
+	hostnameCache sync.Map // Cache for reverse DNS lookups
+	accessLog     *accesslog.Logger
 }
 
 type cachedHostname struct {
@@ -47,7 +60,7 @@ func NewRequestTrackingWrapper(next httputils.RequestProcessor) *RequestTracking
 		defer ticker.Stop()
 		for {
 			<-ticker.C
-			slog.Debug("In-progress connections update", "count", rtw.inProgressConnections.Load())
+			slog.Debug("In-progress connections update", "count", rtw.connections.len())
 		}
 	}()
 
@@ -64,6 +77,26 @@ func NewRequestTrackingWrapper(next httputils.RequestProcessor) *RequestTracking
 	return rtw
 }
 
+// Drain waits for the requests in progress to finish, if ctx ends first their connections are closed
+func (rtw *RequestTrackingWrapper) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for rtw.connections.len() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			open := rtw.connections.all()
+			slog.Warn("closing connections still in progress", "count", len(open))
+			for _, c := range open {
+				c.kill()
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
 func (rtw *RequestTrackingWrapper) cleanExpiredCacheEntries() {
 	now := time.Now()
 	rtw.hostnameCache.Range(func(key, value interface{}) bool {
@@ -105,26 +138,133 @@ func (rtw *RequestTrackingWrapper) getHostname(remoteAddr string) string {
 
 func (rtw *RequestTrackingWrapper) ProcessRequest(r *http.Request, w http.ResponseWriter) error {
 
-	rtw.inProgressConnections.Add(1)
+	activeRequests.Inc()
 
 	// Perform reverse lookup and get the hostname
 	hostname := rtw.getHostname(r.RemoteAddr)
 
 	logEntryContext := slog.With(
 		"destination", r.URL.Hostname(), "destinationPort", r.URL.Port(),
-		"method", r.Method, "from", r.RemoteAddr, "fromHost", hostname)
+		"method", r.Method, "from", r.RemoteAddr, "fromHost", hostname, "user", httputils.UserFromRequest(r))
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r, info := httputils.WithRequestInfo(r.WithContext(ctx))
+
+	conn := newConnection(r, info)
+	conn.cancel = cancel
+	// NoBody is left alone, the transport only sends requests without a length if they have a body
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingReader{ReadCloser: r.Body, n: &conn.upstream}
+	}
+	recorder := newStatusRecorder(w, conn)
+	conn.closer = recorder
+	rtw.connections.add(conn)
 
-	start := time.Now()
-	err := rtw.next.ProcessRequest(r, w)
-	logEntryContext = logEntryContext.With("duration", time.Since(start).Milliseconds())
+	err := rtw.next.ProcessRequest(r, recorder)
+	duration := time.Since(conn.started)
+	rtw.connections.remove(conn)
+	logEntryContext = logEntryContext.With("duration", duration.Milliseconds())
 
-	rtw.inProgressConnections.Add(-1)
+	activeRequests.Dec()
 
+	mode := metrics.Mode()
+	metrics.RequestsTotal.WithLabelValues(mode, metrics.MethodLabel(r.Method), info.Provider(), metrics.StatusLabel(recorder.Status())).Inc()
+	if r.Method == http.MethodConnect {
+		metrics.TunnelDuration.WithLabelValues(mode, info.Provider()).Observe(duration.Seconds())
+	}
+
+	if rule := info.Rule(); rule != "" {
+		logEntryContext = logEntryContext.With("rule", rule)
+	}
+	if provider := info.Provider(); provider != "" {
+		logEntryContext = logEntryContext.With("provider", provider)
+	}
+
+	rtw.logAccess(r, conn, recorder.Status(), err)
 	if err != nil {
-		logEntryContext.Info("request error", "error", err)
+		logEntryContext.Log(ctx, rtw.requestLogLevel(), "request error", "error", err)
 	} else {
-		logEntryContext.Info("request processed")
+		logEntryContext.Log(ctx, rtw.requestLogLevel(), "request processed")
 	}
 
 	return err
 }
+
+// DialPacket tracks and logs UDP associations when the wrapped processor supports them
+func (rtw *RequestTrackingWrapper) DialPacket(r *http.Request) (udprelay.Conn, error) {
+	dialer, ok := rtw.next.(udprelay.Dialer)
+	if !ok {
+		return nil, errors.New("udp relay not supported")
+	}
+
+	logEntryContext := slog.With(
+		"destination", r.URL.Hostname(), "destinationPort", r.URL.Port(),
+		"method", r.Method, "from", r.RemoteAddr, "fromHost", rtw.getHostname(r.RemoteAddr),
+		"user", httputils.UserFromRequest(r))
+
+	r, info := httputils.WithRequestInfo(r)
+
+	conn, err := dialer.DialPacket(r)
+	if err != nil {
+		metrics.RequestsTotal.WithLabelValues(metrics.Mode(), udprelay.MethodAssociate, info.Provider(), "error").Inc()
+		logEntryContext.Info("udp association error", "error", err)
+		return nil, err
+	}
+
+	metrics.RequestsTotal.WithLabelValues(metrics.Mode(), udprelay.MethodAssociate, info.Provider(), metrics.StatusLabel(http.StatusOK)).Inc()
+	activeAssociations.Inc()
+	logEntryContext.Info("udp association opened", "provider", info.Provider())
+
+	association := newConnection(r, info)
+	association.udp = true
+	tracked := &trackedPacketConn{Conn: conn, connection: association}
+	association.closer = tracked
+	rtw.connections.add(association)
+
+	tracked.onClose = func() {
+		rtw.connections.remove(association)
+		activeAssociations.Dec()
+		rtw.logAccess(r, association, http.StatusOK, nil)
+	}
+	return tracked, nil
+}
+
+func newConnection(r *http.Request, info *httputils.RequestInfo) *connection {
+	destination := r.URL.Host
+	if destination == "" {
+		destination = r.Host
+	}
+	return &connection{
+		client:      r.RemoteAddr,
+		user:        httputils.UserFromRequest(r),
+		method:      r.Method,
+		destination: destination,
+		info:        info,
+	}
+}
+
+// trackedPacketConn counts the datagrams relayed and runs onClose once when the association is closed
+type trackedPacketConn struct {
+	udprelay.Conn
+	connection *connection
+	closeOnce  sync.Once
+	onClose    func()
+}
+
+func (c *trackedPacketConn) ReadDatagram(p []byte) (int, string, error) {
+	n, addr, err := c.Conn.ReadDatagram(p)
+	c.connection.downstream.Add(int64(n))
+	return n, addr, err
+}
+
+func (c *trackedPacketConn) WriteDatagram(p []byte, addr string) (int, error) {
+	n, err := c.Conn.WriteDatagram(p, addr)
+	c.connection.upstream.Add(int64(n))
+	return n, err
+}
+
+func (c *trackedPacketConn) Close() error {
+	c.closeOnce.Do(c.onClose)
+	return c.Conn.Close()
+}
@@ -0,0 +1,187 @@
+package requestlogging
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rhysbryant/proxylink/pkg/httputils"
+)
+
+const (
+	KindRequest = "request"
+	KindTunnel  = "tunnel"
+	KindUDP     = "udp"
+)
+
+// ids are unique across trackers so an id identifies a single connection
+var nextConnectionID atomic.Uint64
+
+// connection is a request, tunnel or UDP association in progress
+type connection struct {
+	id          uint64
+	client      string
+	user        string
+	method      string
+	destination string
+	info        *httputils.RequestInfo
+	started     time.Time
+	udp         bool
+	hijacked    atomic.Bool
+
+	// bytes read from and written to the client
+	upstream   atomic.Int64
+	downstream atomic.Int64
+
+	// cancel ends a request that has not been hijacked, closer closes the hijacked connection or association
+	cancel context.CancelFunc
+	closer io.Closer
+}
+
+func (c *connection) kill() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.closer != nil {
+		c.closer.Close()
+	}
+}
+
+func (c *connection) kind() string {
+	if c.udp {
+		return KindUDP
+	} else if c.hijacked.Load() {
+		return KindTunnel
+	}
+	return KindRequest
+}
+
+// ConnectionInfo describes a connection in progress
+type ConnectionInfo struct {
+	ID          uint64    `json:"id"`
+	Kind        string    `json:"kind"` // request, tunnel or udp
+	Client      string    `json:"client"`
+	User        string    `json:"user,omitempty"`
+	Method      string    `json:"method"`
+	Destination string    `json:"destination"`
+	Rule        string    `json:"rule,omitempty"`
+	Provider    string    `json:"provider,omitempty"`
+	Started     time.Time `json:"started"`
+	Age         float64   `json:"ageSeconds"`
+	Upstream    int64     `json:"bytesUpstream"`   // from the client
+	Downstream  int64     `json:"bytesDownstream"` // to the client
+}
+
+// registry holds the connections a tracker has in progress
+type registry struct {
+	mu          sync.Mutex
+	connections map[uint64]*connection
+}
+
+func (reg *registry) add(c *connection) {
+	c.id = nextConnectionID.Add(1)
+	c.started = time.Now()
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.connections == nil {
+		reg.connections = map[uint64]*connection{}
+	}
+	reg.connections[c.id] = c
+}
+
+func (reg *registry) remove(c *connection) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.connections, c.id)
+}
+
+func (reg *registry) len() int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return len(reg.connections)
+}
+
+func (reg *registry) all() []*connection {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	all := make([]*connection, 0, len(reg.connections))
+	for _, c := range reg.connections {
+		all = append(all, c)
+	}
+	slices.SortFunc(all, func(a, b *connection) int { return cmp.Compare(a.id, b.id) })
+	return all
+}
+
+func (reg *registry) get(id uint64) *connection {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.connections[id]
+}
+
+// Connections returns the connections in progress, oldest first
+func (rtw *RequestTrackingWrapper) Connections() []ConnectionInfo {
+	now := time.Now()
+	var infos []ConnectionInfo
+	for _, c := range rtw.connections.all() {
+		infos = append(infos, ConnectionInfo{
+			ID:          c.id,
+			Kind:        c.kind(),
+			Client:      c.client,
+			User:        c.user,
+			Method:      c.method,
+			Destination: c.destination,
+			Rule:        c.info.Rule(),
+			Provider:    c.info.Provider(),
+			Started:     c.started,
+			Age:         now.Sub(c.started).Seconds(),
+			Upstream:    c.upstream.Load(),
+			Downstream:  c.downstream.Load(),
+		})
+	}
+	return infos
+}
+
+// Kill ends the connection with id, it reports false if the tracker has no such connection
+func (rtw *RequestTrackingWrapper) Kill(id uint64) bool {
+	c := rtw.connections.get(id)
+	if c == nil {
+		return false
+	}
+	c.kill()
+	return true
+}
+
+// countingReader counts the bytes read into n
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
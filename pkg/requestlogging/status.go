@@ -0,0 +1,125 @@
+package requestlogging
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// statusRecorder remembers the response status, tunnels write their status as raw HTTP
+// to the hijacked connection so the first line written there is parsed too.
+// the bytes passing through are counted on the connection
+type statusRecorder struct {
+	http.ResponseWriter
+	connection *connection
+	status     atomic.Int32
+	hijacked   atomic.Pointer[statusConn]
+}
+
+func newStatusRecorder(w http.ResponseWriter, c *connection) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, connection: c}
+}
+
+// Status returns the status code written or 0 if none was
+func (r *statusRecorder) Status() int {
+	return int(r.status.Load())
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.status.CompareAndSwap(0, int32(statusCode))
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	r.status.CompareAndSwap(0, http.StatusOK)
+	n, err := r.ResponseWriter.Write(data)
+	r.connection.downstream.Add(int64(n))
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	sc := &statusConn{Conn: conn, recorder: r}
+	r.hijacked.Store(sc)
+	r.connection.hijacked.Store(true)
+	return sc, rw, nil
+}
+
+// Close closes the hijacked connection if there is one, requests that were not hijacked are left to the server
+func (r *statusRecorder) Close() error {
+	if conn := r.hijacked.Load(); conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// statusConn reads the status line of the first response written to a hijacked connection
+type statusConn struct {
+	net.Conn
+	recorder *statusRecorder
+	checked  atomic.Bool
+}
+
+func (c *statusConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.recorder.connection.upstream.Add(int64(n))
+	return n, err
+}
+
+func (c *statusConn) Write(data []byte) (int, error) {
+	if !c.checked.Swap(true) {
+		if status, ok := parseStatusLine(data); ok {
+			c.recorder.status.CompareAndSwap(0, int32(status))
+		}
+	}
+	n, err := c.Conn.Write(data)
+	c.recorder.connection.downstream.Add(int64(n))
+	return n, err
+}
+
+// parseStatusLine returns the status code from a line such as "HTTP/1.1 200 Connection Established"
+func parseStatusLine(data []byte) (int, bool) {
+	if !bytes.HasPrefix(data, []byte("HTTP/1.")) || len(data) < 12 || data[8] != ' ' {
+		return 0, false
+	}
+	status, err := strconv.Atoi(string(data[9:12]))
+	if err != nil {
+		return 0, false
+	}
+	return status, true
+}
@@ -0,0 +1,87 @@
+package rulesengine
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// how long a rule with a destinationIP, country or asn condition waits for the hostname to resolve
+const resolveTimeout = 5 * time.Second
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSource returns the address of the client from a remote address such as 192.0.2.1:5000
+func parseSource(remoteAddr string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return addrPort.Addr(), true
+	}
+	addr, err := netip.ParseAddr(remoteAddr)
+	return addr, err == nil
+}
+
+// destinationAddrs returns the target as an address, or the addresses the hostname resolves to.
+// they are looked up the first time a rule needs them and reused for the rules after it
+type destinationAddrs struct {
+	host     string
+	resolved bool
+	addrs    []netip.Addr
+}
+
+func (d *destinationAddrs) get() []netip.Addr {
+	if d.resolved {
+		return d.addrs
+	}
+	d.resolved = true
+
+	if addr, err := netip.ParseAddr(d.host); err == nil {
+		d.addrs = []netip.Addr{addr}
+		return d.addrs
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", d.host)
+	if err != nil {
+		slog.Debug("failed to resolve target for destination rules", "host", d.host, "error", err)
+	}
+	d.addrs = addrs
+	return d.addrs
+}
+
+func (d *destinationAddrs) in(prefixes []netip.Prefix) bool {
+	for _, addr := range d.get() {
+		if containsAddr(prefixes, addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package rulesengine
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultConnectPorts are the ports tunnels may be opened to when none are configured
+var DefaultConnectPorts = []string{"443"}
+
+// ConnectPolicy restricts the tunnels CONNECT requests may open, this includes SOCKS5 and transparent connections
+type ConnectPolicy struct {
+	Ports   []string `yaml:"ports,omitempty" json:"ports,omitempty"`     // ports or ranges such as 8000-8999, DefaultConnectPorts if empty
+	TLSOnly bool     `yaml:"tlsOnly,omitempty" json:"tlsOnly,omitempty"` // close tunnels that do not start with a TLS handshake
+}
+
+type portRange struct {
+	from, to uint16
+}
+
+type compiledConnectPolicy struct {
+	ports   []portRange
+	tlsOnly bool
+}
+
+func compileConnectPolicy(policy ConnectPolicy) (*compiledConnectPolicy, error) {
+	ports := policy.Ports
+	if len(ports) == 0 {
+		ports = DefaultConnectPorts
+	}
+
+	compiled := &compiledConnectPolicy{tlsOnly: policy.TLSOnly}
+	for _, port := range ports {
+		from, to, isRange := strings.Cut(strings.TrimSpace(port), "-")
+		if !isRange {
+			to = from
+		}
+
+		first, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connect port %q", port)
+		}
+		last, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("invalid connect port range %q", port)
+		}
+		compiled.ports = append(compiled.ports, portRange{from: uint16(first), to: uint16(last)})
+	}
+	return compiled, nil
+}
+
+// allowsPort reports whether a tunnel may be opened to port, an empty port is the CONNECT default of 443
+func (p *compiledConnectPolicy) allowsPort(port string) bool {
+	if port == "" {
+		port = "443"
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return false
+	}
+
+	for _, r := range p.ports {
+		if uint16(number) >= r.from && uint16(number) <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+var errNotTLS = errors.New("tunnel did not start with a TLS handshake")
+
+// tlsOnlyWriter checks that the client starts the tunnel it hijacks with a TLS handshake record
+type tlsOnlyWriter struct {
+	http.ResponseWriter
+}
+
+func (w *tlsOnlyWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tlsOnlyConn{Conn: conn}, rw, nil
+}
+
+// tlsOnlyConn reads the first bytes of a TLS record header before passing reads through,
+// the connection is closed if they are not a handshake record
+type tlsOnlyConn struct {
+	net.Conn
+
+	checkOnce sync.Once
+	checkErr  error
+	header    []byte
+}
+
+func (c *tlsOnlyConn) Read(p []byte) (int, error) {
+	c.checkOnce.Do(func() {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			c.checkErr = err
+			return
+		}
+		// content type handshake followed by the major version of TLS 1.0 to 1.3
+		if header[0] != 0x16 || header[1] != 0x03 {
+			c.Conn.Close()
+			c.checkErr = errNotTLS
+			return
+		}
+		c.header = header
+	})
+
+	if c.checkErr != nil {
+		return 0, c.checkErr
+	}
+	if len(c.header) > 0 {
+		n := copy(p, c.header)
+		c.header = c.header[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
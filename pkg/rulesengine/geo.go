@@ -0,0 +1,107 @@
+package rulesengine
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// GeoIP finds where addresses are for rules with country and ASN conditions, see the geoip package.
+// a nil function means the database is not loaded and rules needing it are rejected
+type GeoIP struct {
+	Country func(addr netip.Addr) string // ISO code of the country, empty if it is not known
+	ASN     func(addr netip.Addr) uint32 // autonomous system number, 0 if it is not known
+}
+
+type geoConditions struct {
+	// nil when the rule has no such condition
+	countries       map[string]struct{}
+	sourceCountries map[string]struct{}
+	asns            []uint32
+}
+
+func compileGeoConditions(rule Rule, geo GeoIP) (geoConditions, error) {
+	var conditions geoConditions
+	var err error
+
+	if (len(rule.Country) > 0 || len(rule.SourceCountry) > 0) && geo.Country == nil {
+		return conditions, errors.New("country conditions need geoip.countryDB")
+	}
+	if len(rule.ASN) > 0 && geo.ASN == nil {
+		return conditions, errors.New("asn conditions need geoip.asnDB")
+	}
+
+	if conditions.countries, err = parseCountries(rule.Country); err != nil {
+		return conditions, fmt.Errorf("country: %w", err)
+	}
+	if conditions.sourceCountries, err = parseCountries(rule.SourceCountry); err != nil {
+		return conditions, fmt.Errorf("sourceCountry: %w", err)
+	}
+	conditions.asns = rule.ASN
+	return conditions, nil
+}
+
+func parseCountries(codes []string) (map[string]struct{}, error) {
+	if len(codes) == 0 {
+		return nil, nil
+	}
+
+	countries := map[string]struct{}{}
+	for _, code := range codes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if len(code) != 2 {
+			return nil, fmt.Errorf("invalid country code %q, expected two letters such as NZ", code)
+		}
+		countries[code] = struct{}{}
+	}
+	return countries, nil
+}
+
+// matchSource reports whether the client address is in one of the source countries
+func (c *geoConditions) matchSource(geo GeoIP, source netip.Addr, sourceOK bool) bool {
+	if c.sourceCountries == nil {
+		return true
+	}
+	if !sourceOK {
+		return false
+	}
+	_, ok := c.sourceCountries[geo.Country(source)]
+	return ok
+}
+
+// matchDestination reports whether the target address, or one its hostname resolves to, is in one of the countries
+// and one of the autonomous systems
+func (c *geoConditions) matchDestination(geo GeoIP, destination *destinationAddrs) bool {
+	if c.countries != nil && !slices.ContainsFunc(destination.get(), func(addr netip.Addr) bool {
+		_, ok := c.countries[geo.Country(addr)]
+		return ok
+	}) {
+		return false
+	}
+
+	if c.asns != nil && !slices.ContainsFunc(destination.get(), func(addr netip.Addr) bool {
+		return slices.Contains(c.asns, geo.ASN(addr))
+	}) {
+		return false
+	}
+	return true
+}
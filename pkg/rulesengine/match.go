@@ -0,0 +1,104 @@
+package rulesengine
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MatchType is how a rule's targets are compared with the hostname of a request
+type MatchType string
+
+const (
+	// the hostname and its subdomains, example.com matches www.example.com but not badexample.com
+	MatchDomain MatchType = "domain"
+	// the hostname only
+	MatchExact MatchType = "exact"
+	// * matches any run of characters including dots and ? a single character, *.cdn.* matches img.cdn.example.com
+	MatchGlob MatchType = "glob"
+	// a regular expression that must match the whole hostname
+	MatchRegex MatchType = "regex"
+	// any hostname ending with the target, ample.com matches example.com. this was the only behaviour before match types
+	MatchSuffix MatchType = "suffix"
+)
+
+// hostMatcher reports whether a normalized hostname matches one of a rule's targets
+type hostMatcher func(host string) bool
+
+// normalizeHost lower cases the hostname and drops the trailing dot of a fully qualified name
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// compileTargets builds the matcher for glob, regex and suffix targets once so requests do not parse patterns.
+// domain and exact targets are matched by the engine's domainTrie
+func compileTargets(matchType MatchType, targets []string) (hostMatcher, error) {
+	switch matchType {
+	case MatchGlob, MatchRegex:
+		patterns := make([]string, len(targets))
+		for i, target := range targets {
+			if matchType == MatchGlob {
+				patterns[i] = globToRegex(normalizeHost(target))
+				continue
+			}
+			if _, err := regexp.Compile(target); err != nil {
+				return nil, fmt.Errorf("invalid regex target %q: %w", target, err)
+			}
+			patterns[i] = "(?:" + target + ")"
+		}
+		// the targets are combined so a request is matched in a single pass
+		re, err := regexp.Compile("(?i)^(?:" + strings.Join(patterns, "|") + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s targets: %w", matchType, err)
+		}
+		return re.MatchString, nil
+
+	case MatchSuffix:
+		suffixes := make([]string, len(targets))
+		for i, target := range targets {
+			suffixes[i] = strings.ToLower(target)
+		}
+		return func(host string) bool {
+			for _, suffix := range suffixes {
+				if strings.HasSuffix(host, suffix) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown match type %q", matchType)
+}
+
+func globToRegex(glob string) string {
+	var pattern strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return pattern.String()
+}
@@ -0,0 +1,131 @@
+package rulesengine
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// requestConditions are the conditions on the HTTP request itself, tunnels only have a method and headers
+// so path and query conditions apply to plain requests and the requests inside intercepted tunnels
+type requestConditions struct {
+	paths     []string
+	pathRegex *regexp.Regexp
+	methods   map[string]struct{}
+	query     map[string]*regexp.Regexp
+	headers   map[string]*regexp.Regexp
+}
+
+func compileRequestConditions(rule Rule) (requestConditions, error) {
+	var conditions requestConditions
+	var err error
+
+	conditions.paths = rule.Path
+	if rule.PathRegex != "" {
+		if conditions.pathRegex, err = regexp.Compile(rule.PathRegex); err != nil {
+			return conditions, fmt.Errorf("invalid pathRegex: %w", err)
+		}
+	}
+
+	if len(rule.Method) > 0 {
+		conditions.methods = map[string]struct{}{}
+		for _, method := range rule.Method {
+			conditions.methods[strings.ToUpper(strings.TrimSpace(method))] = struct{}{}
+		}
+	}
+
+	if conditions.query, err = compileValuePatterns(rule.Query, func(name string) string { return name }); err != nil {
+		return conditions, fmt.Errorf("query: %w", err)
+	}
+	if conditions.headers, err = compileValuePatterns(rule.Headers, http.CanonicalHeaderKey); err != nil {
+		return conditions, fmt.Errorf("headers: %w", err)
+	}
+	return conditions, nil
+}
+
+func compileValuePatterns(patterns map[string]string, key func(string) string) (map[string]*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	compiled := map[string]*regexp.Regexp{}
+	for name, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for %s: %w", name, err)
+		}
+		compiled[key(name)] = re
+	}
+	return compiled, nil
+}
+
+func (c *requestConditions) match(r *http.Request) bool {
+	if c.methods != nil {
+		if _, ok := c.methods[r.Method]; !ok {
+			return false
+		}
+	}
+
+	if len(c.paths) > 0 || c.pathRegex != nil {
+		path := r.URL.Path
+		if len(c.paths) > 0 && !hasAnyPrefix(path, c.paths) {
+			return false
+		}
+		if c.pathRegex != nil && !c.pathRegex.MatchString(path) {
+			return false
+		}
+	}
+
+	if c.query != nil {
+		query := r.URL.Query()
+		for name, re := range c.query {
+			if !anyMatch(re, query[name]) {
+				return false
+			}
+		}
+	}
+
+	for name, re := range c.headers {
+		if !anyMatch(re, r.Header.Values(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyMatch reports whether one of values matches re, a missing value never matches
+func anyMatch(re *regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -18,42 +18,122 @@ package rulesengine
 */
 import (
 	"errors"
+	"fmt"
+	"maps"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/rhysbryant/proxylink/pkg/httputils"
+	"github.com/rhysbryant/proxylink/pkg/metrics"
+	"github.com/rhysbryant/proxylink/pkg/mitm"
+	"github.com/rhysbryant/proxylink/pkg/proxy"
+	"github.com/rhysbryant/proxylink/pkg/udprelay"
 )
 
-const DefaultProviderName = "DIRECT"
+const DefaultProviderName = proxy.DirectProviderName
 
 type RequestWrapper struct {
-	proxyProviders map[string]httputils.RequestProcessor
+	table atomic.Pointer[routingTable]
+
+	// tunnels are decrypted and their requests passed to interceptHandler when interception applies to the rule they match
+	interceptor        *mitm.Interceptor
+	interceptByDefault bool
+	interceptHandler   httputils.RequestProcessor
+}
+
+// routingTable is replaced as a whole on reload so a request sees either the old or the new rules and providers
+type routingTable struct {
 	rulesEngine    *RulesEngine
+	proxyProviders map[string]httputils.RequestProcessor
 }
 
 func NewRequestWrapper(rulesEngine *RulesEngine) *RequestWrapper {
 
-	return &RequestWrapper{rulesEngine: rulesEngine, proxyProviders: map[string]httputils.RequestProcessor{}}
+	rw := &RequestWrapper{}
+	rw.table.Store(&routingTable{rulesEngine: rulesEngine, proxyProviders: map[string]httputils.RequestProcessor{}})
+	return rw
 }
 
+// AddProxyProvider registers a provider, it is meant for setting up the wrapper before it is used.
+// use Update to change providers while requests are being processed
 func (rw *RequestWrapper) AddProxyProvider(name string, provider httputils.RequestProcessor) {
-	rw.proxyProviders[name] = provider
+	rw.table.Load().proxyProviders[name] = provider
+}
+
+// Update atomically replaces the rules and providers, requests already in progress finish with the ones they started with
+func (rw *RequestWrapper) Update(rulesEngine *RulesEngine, providers map[string]httputils.RequestProcessor) {
+	rw.table.Store(&routingTable{rulesEngine: rulesEngine, proxyProviders: providers})
+}
+
+// RulesEngine returns the rules currently in use
+func (rw *RequestWrapper) RulesEngine() *RulesEngine {
+	return rw.table.Load().rulesEngine
+}
+
+// SetInterceptor decrypts tunnels with interceptor and passes the requests inside them to handler, which normally
+// leads back to this wrapper. byDefault applies to rules that do not set intercept. it is meant for setting up the wrapper before it is used
+func (rw *RequestWrapper) SetInterceptor(interceptor *mitm.Interceptor, byDefault bool, handler httputils.RequestProcessor) {
+	rw.interceptor = interceptor
+	rw.interceptByDefault = byDefault
+	rw.interceptHandler = handler
+}
+
+func (rw *RequestWrapper) intercepts(rule *Rule) bool {
+	if rw.interceptor == nil {
+		return false
+	}
+	if rule.Intercept != nil {
+		return *rule.Intercept
+	}
+	return rw.interceptByDefault
+}
+
+// Providers returns the providers requests are currently routed to by name
+func (rw *RequestWrapper) Providers() map[string]httputils.RequestProcessor {
+	return maps.Clone(rw.table.Load().proxyProviders)
+}
+
+// findMatch matches r against the rules and records the matching rule
+func (t *routingTable) findMatch(r *http.Request) *Rule {
+	result := t.rulesEngine.FindMatch(r)
+
+	httputils.RequestInfoFromRequest(r).SetRule(result.Name)
+	metrics.RuleMatches.WithLabelValues(result.Name).Inc()
+
+	return result
 }
 
 func (rw *RequestWrapper) ProcessRequest(r *http.Request, w http.ResponseWriter) error {
 
-	result := rw.rulesEngine.FindMatch(r.URL, r.RemoteAddr)
+	table := rw.table.Load()
+	result := table.findMatch(r)
 
 	if result.Block {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return errors.New("request blocked by rules engine")
 	} else {
+		if r.Method == http.MethodConnect {
+			policy := table.rulesEngine.connectPolicy(result)
+			if !policy.allowsPort(r.URL.Port()) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return fmt.Errorf("tunnels to port %s are not allowed", r.URL.Port())
+			}
+			if rw.intercepts(result) {
+				httputils.RequestInfoFromRequest(r).SetProvider(mitm.ProviderName)
+				return rw.interceptor.Intercept(r, w, rw.interceptHandler)
+			}
+			if policy.tlsOnly {
+				w = &tlsOnlyWriter{ResponseWriter: w}
+			}
+		}
+
 		//default to direct if no exit node specified
 		var providerName = DefaultProviderName
 		if result.Exit != nil {
-			providerName = result.Exit.URL
+			providerName = result.Exit.ProviderName()
 		}
 
-		provider, ok := rw.proxyProviders[providerName]
+		provider, ok := table.proxyProviders[providerName]
 		if !ok {
 			http.Error(w, "Proxy provider not found", http.StatusInternalServerError)
 			return nil
@@ -63,3 +143,31 @@ func (rw *RequestWrapper) ProcessRequest(r *http.Request, w http.ResponseWriter)
 	}
 
 }
+
+// DialPacket routes a UDP association through the provider selected by the rules engine
+func (rw *RequestWrapper) DialPacket(r *http.Request) (udprelay.Conn, error) {
+
+	table := rw.table.Load()
+	result := table.findMatch(r)
+
+	if result.Block {
+		return nil, errors.New("request blocked by rules engine")
+	}
+
+	var providerName = DefaultProviderName
+	if result.Exit != nil {
+		providerName = result.Exit.ProviderName()
+	}
+
+	provider, ok := table.proxyProviders[providerName]
+	if !ok {
+		return nil, fmt.Errorf("proxy provider %s not found", providerName)
+	}
+
+	dialer, ok := provider.(udprelay.Dialer)
+	if !ok {
+		return nil, fmt.Errorf("proxy provider %s does not support udp", providerName)
+	}
+
+	return dialer.DialPacket(r)
+}
@@ -16,15 +16,78 @@ package rulesengine
  You should have received a copy of the GNU General Public License
  along with this program. If not, see <https://www.gnu.org/licenses/>.
 */
+import "time"
+
 type ExiteNode struct {
-	URL string `yaml:"url"`
-	Key string `yaml:"key,omitempty"`
+	URL   string     `yaml:"url"`
+	Key   string     `yaml:"key,omitempty"`
+	Group string     `yaml:"group,omitempty"` // name of an exit group to use instead of a single url
+	Via   *ExiteNode `yaml:"via,omitempty"`   // reach the exit node through a tunnel over this node
+}
+
+// ProviderName is the name the exit node or group is registered under with the RequestWrapper
+func (e *ExiteNode) ProviderName() string {
+	if e.Group != "" {
+		return "group:" + e.Group
+	}
+	if e.Via != nil {
+		return e.URL + " via " + e.Via.ProviderName()
+	}
+	return e.URL
+}
+
+// ExitGroup is a set of exit nodes used together, see proxy.ExitGroup
+type ExitGroup struct {
+	Strategy    string        `yaml:"strategy"`    // failover, round-robin, least-connections or latency
+	Key         string        `yaml:"key"`         // default key for nodes that do not set one
+	HealthCheck time.Duration `yaml:"healthCheck"` // interval between health checks
+	Nodes       []ExiteNode   `yaml:"nodes"`
+}
+
+// StringList is a list of strings that may also be written in yaml as a single string
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*l = nil
+		if single != "" {
+			*l = StringList{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
 }
 
 type Rule struct {
-	Block      bool       `yaml:"block"`
-	Target     []string   `yaml:"target"`
-	TargetPort string     `yaml:"targetPort"`
-	Source     string     `yaml:"source"`
-	Exit       *ExiteNode `yaml:"proxy,omitempty"`
+	Name          string            `yaml:"name"` // shown in logs and metrics, defaults to the position of the rule
+	Block         bool              `yaml:"block"`
+	Target        []string          `yaml:"target"`
+	Match         MatchType         `yaml:"match,omitempty"` // how targets are compared with the hostname, domain by default
+	Lists         []string          `yaml:"lists"`           // names of domain lists whose hostnames are matched as well as the targets
+	TargetPort    string            `yaml:"targetPort"`
+	Source        StringList        `yaml:"source"`        // client addresses or CIDR ranges
+	DestinationIP StringList        `yaml:"destinationIP"` // CIDR ranges the target address or the addresses its hostname resolves to must be in
+	Country       StringList        `yaml:"country"`       // ISO codes of countries the target address or the addresses its hostname resolves to must be in
+	ASN           []uint32          `yaml:"asn"`           // autonomous systems the target address or the addresses its hostname resolves to must be in
+	SourceCountry StringList        `yaml:"sourceCountry"` // ISO codes of countries the client address must be in
+	Users         []string          `yaml:"users"`         // authenticated usernames the rule applies to
+	Method        StringList        `yaml:"method"`
+	Path          StringList        `yaml:"path"`      // URL path prefixes, plain and intercepted requests only
+	PathRegex     string            `yaml:"pathRegex"` // regular expression the URL path must match, plain and intercepted requests only
+	Query         map[string]string `yaml:"query"`     // regular expressions by parameter name, the parameter must be present
+	Headers       map[string]string `yaml:"headers"`   // regular expressions by header name, the header must be present
+	Exit          *ExiteNode        `yaml:"proxy,omitempty"`
+	Connect       *ConnectPolicy    `yaml:"connect,omitempty"`   // replaces the global connect policy for requests matching the rule
+	Intercept     *bool             `yaml:"intercept,omitempty"` // decrypt tunnels matching the rule, false bypasses interception for pinned or sensitive hosts
+	Schedule      *Schedule         `yaml:"schedule,omitempty"`  // times the rule applies, always if not set
+
+	// compiled from Connect when the rules are loaded
+	connect *compiledConnectPolicy
 }
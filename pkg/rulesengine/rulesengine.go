@@ -17,18 +17,160 @@ package rulesengine
  along with this program. If not, see <https://www.gnu.org/licenses/>.
 */
 import (
-	"net/url"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/rhysbryant/proxylink/pkg/domainlist"
+	"github.com/rhysbryant/proxylink/pkg/httputils"
+	"github.com/rhysbryant/proxylink/pkg/netpolicy"
 )
 
 type RulesEngine struct {
 	rules       []Rule
+	compiled    []compiledRule
 	defaultRule Rule
+	// applies to rules without their own connect policy
+	connect *compiledConnectPolicy
+	clock   Clock
+	geo     GeoIP
+	// domain and exact targets of every rule
+	domains domainTrie
+}
+
+// compiledRule holds the conditions of a rule parsed when the rules are loaded
+type compiledRule struct {
+	// glob, regex and suffix targets, nil when the rule has none
+	targets hostMatcher
+	// the rule has domain or exact targets or lists, they are in the engine's domain index
+	indexed        bool
+	sources        []netip.Prefix
+	destinationIPs []netip.Prefix
+	request        requestConditions
+	geo            geoConditions
+	// nil when the rule has no schedule
+	schedule *compiledSchedule
 }
 
-func NewRulesEngine(rules []Rule) *RulesEngine {
-	return &RulesEngine{rules: rules}
+// DefaultRuleName is reported when no rule matches a request
+const DefaultRuleName = "default"
+
+// NewRulesEngine compiles the conditions of rules, an error is returned for unknown match types and invalid patterns, addresses or ports.
+// connect applies to CONNECT requests matching rules that do not have their own connect policy, lists are the domain lists rules may name
+// and geo looks up the countries and autonomous systems of addresses
+func NewRulesEngine(rules []Rule, connect ConnectPolicy, lists map[string]*domainlist.List, geo GeoIP) (*RulesEngine, error) {
+	re := &RulesEngine{
+		rules:       make([]Rule, len(rules)),
+		compiled:    make([]compiledRule, len(rules)),
+		defaultRule: Rule{Name: DefaultRuleName},
+		clock:       time.Now,
+		geo:         geo,
+	}
+
+	var err error
+	if re.connect, err = compileConnectPolicy(connect); err != nil {
+		return nil, err
+	}
 
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = "rule " + strconv.Itoa(i+1)
+		}
+		if rule.Connect != nil {
+			if rule.connect, err = compileConnectPolicy(*rule.Connect); err != nil {
+				return nil, fmt.Errorf("%s: %w", rule.Name, err)
+			}
+		}
+		re.rules[i] = rule
+
+		compiled, err := compileRule(rule, geo)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		if compiled.indexed, err = re.indexTargets(i, rule, lists); err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		re.compiled[i] = compiled
+	}
+
+	return re, nil
+}
+
+// connectPolicy returns the policy for CONNECT requests matching rule
+func (re *RulesEngine) connectPolicy(rule *Rule) *compiledConnectPolicy {
+	if rule.connect != nil {
+		return rule.connect
+	}
+	return re.connect
+}
+
+func compileRule(rule Rule, geo GeoIP) (compiledRule, error) {
+	var compiled compiledRule
+	var err error
+
+	indexedMatch := rule.Match == "" || rule.Match == MatchDomain || rule.Match == MatchExact
+	if len(rule.Target) > 0 && !indexedMatch {
+		if compiled.targets, err = compileTargets(rule.Match, rule.Target); err != nil {
+			return compiled, err
+		}
+	}
+	if compiled.sources, err = netpolicy.ParsePrefixes(rule.Source); err != nil {
+		return compiled, fmt.Errorf("source: %w", err)
+	}
+	if compiled.destinationIPs, err = netpolicy.ParsePrefixes(rule.DestinationIP); err != nil {
+		return compiled, fmt.Errorf("destinationIP: %w", err)
+	}
+	if compiled.request, err = compileRequestConditions(rule); err != nil {
+		return compiled, err
+	}
+	if compiled.schedule, err = compileSchedule(rule.Schedule); err != nil {
+		return compiled, fmt.Errorf("schedule: %w", err)
+	}
+	if compiled.geo, err = compileGeoConditions(rule, geo); err != nil {
+		return compiled, err
+	}
+	return compiled, nil
+}
+
+// indexTargets adds the domain and exact targets of the rule at index i and the hostnames of its lists to the domain index,
+// it reports whether anything was added
+func (re *RulesEngine) indexTargets(i int, rule Rule, lists map[string]*domainlist.List) (bool, error) {
+	indexed := false
+	if rule.Match == "" || rule.Match == MatchDomain || rule.Match == MatchExact {
+		for _, target := range rule.Target {
+			re.domains.add(strings.TrimPrefix(normalizeHost(target), "."), i, rule.Match == MatchExact)
+			indexed = true
+		}
+	}
+
+	for _, name := range rule.Lists {
+		list, ok := lists[name]
+		if !ok {
+			return false, fmt.Errorf("unknown list %q", name)
+		}
+		for _, domain := range list.Domains {
+			re.domains.add(domain, i, false)
+		}
+		for _, host := range list.Hosts {
+			re.domains.add(host, i, true)
+		}
+		indexed = true
+	}
+	return indexed, nil
+}
+
+// SetClock replaces the clock schedules are matched against, time.Now by default
+func (re *RulesEngine) SetClock(clock Clock) {
+	re.clock = clock
+}
+
+// Rules returns the loaded rules in the order they are matched, with their default names filled in
+func (re *RulesEngine) Rules() []Rule {
+	return slices.Clone(re.rules)
 }
 
 func (re *RulesEngine) GetExitNodes() []ExiteNode {
@@ -36,34 +178,50 @@ func (re *RulesEngine) GetExitNodes() []ExiteNode {
 	exitNodes := []ExiteNode{}
 	for _, rule := range re.rules {
 		if rule.Exit != nil {
-			if _, exists := exitNodesMap[rule.Exit.URL]; exists {
+			if _, exists := exitNodesMap[rule.Exit.ProviderName()]; exists {
 				continue
 			}
-			exitNodesMap[rule.Exit.URL] = struct{}{}
+			exitNodesMap[rule.Exit.ProviderName()] = struct{}{}
 			exitNodes = append(exitNodes, *rule.Exit)
 		}
 	}
 	return exitNodes
 }
 
-func hasSuffix(s string, suffixes []string) bool {
-	for _, suffix := range suffixes {
-		if strings.HasSuffix(s, suffix) {
-			return true
-		}
-	}
-	return false
-}
+// FindMatch returns the first rule matching the request, a plain request, a CONNECT request or a request inside an intercepted tunnel
+func (re *RulesEngine) FindMatch(r *http.Request) *Rule {
+	targetHost := normalizeHost(r.URL.Hostname())
+	targetPort := r.URL.Port()
+	sourceAddr, sourceOK := parseSource(r.RemoteAddr)
+	user := httputils.UserFromRequest(r)
+	now := re.clock()
+	destination := &destinationAddrs{host: targetHost}
 
-func (re *RulesEngine) FindMatch(target *url.URL, source string) *Rule {
-	targetHost := target.Hostname()
-	targetPort := target.Port()
-	for _, rule := range re.rules {
-		if (len(rule.Target) == 0 || hasSuffix(targetHost, rule.Target)) &&
-			(rule.Source == "" || rule.Source == source) &&
-			(rule.TargetPort == "" || rule.TargetPort == targetPort) {
+	indexed := make([]bool, len(re.rules))
+	re.domains.match(targetHost, indexed)
+
+	for i, rule := range re.rules {
+		compiled := re.compiled[i]
+		if compiled.matchTarget(targetHost, indexed[i]) &&
+			(len(compiled.sources) == 0 || (sourceOK && containsAddr(compiled.sources, sourceAddr))) &&
+			(rule.TargetPort == "" || rule.TargetPort == targetPort) &&
+			(len(rule.Users) == 0 || slices.Contains(rule.Users, user)) &&
+			compiled.request.match(r) &&
+			(compiled.schedule == nil || compiled.schedule.match(now)) &&
+			compiled.geo.matchSource(re.geo, sourceAddr, sourceOK) &&
+			// checked last as they may need a DNS lookup
+			(len(compiled.destinationIPs) == 0 || destination.in(compiled.destinationIPs)) &&
+			compiled.geo.matchDestination(re.geo, destination) {
 			return &rule
 		}
 	}
 	return &re.defaultRule
 }
+
+// matchTarget reports whether host matches one of the rule's targets or lists, indexed is whether the domain index matched the rule
+func (c *compiledRule) matchTarget(host string, indexed bool) bool {
+	if c.targets == nil && !c.indexed {
+		return true
+	}
+	return indexed || (c.targets != nil && c.targets(host))
+}
@@ -0,0 +1,216 @@
+package rulesengine
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clock returns the current time, rules with a schedule are matched against it
+type Clock func() time.Time
+
+// Schedule limits a rule to certain times, every condition set must match
+type Schedule struct {
+	Days     StringList `yaml:"days,omitempty" json:"days,omitempty"`         // mon to sun or ranges such as mon-fri
+	Times    StringList `yaml:"times,omitempty" json:"times,omitempty"`       // windows such as 09:00-17:00, one ending before it starts runs past midnight
+	Timezone string     `yaml:"timezone,omitempty" json:"timezone,omitempty"` // IANA name such as Europe/London, local time if empty
+	From     string     `yaml:"from,omitempty" json:"from,omitempty"`         // first date the rule applies, 2006-01-02
+	Until    string     `yaml:"until,omitempty" json:"until,omitempty"`       // last date the rule applies
+}
+
+// minutes since midnight, end is exclusive and may be 24:00
+type timeWindow struct {
+	start, end int
+}
+
+type compiledSchedule struct {
+	location *time.Location
+	// nil when every day matches
+	days    *[7]bool
+	windows []timeWindow
+	// dates as yyyymmdd, zero when not set
+	from, until int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func compileSchedule(schedule *Schedule) (*compiledSchedule, error) {
+	if schedule == nil {
+		return nil, nil
+	}
+
+	compiled := &compiledSchedule{location: time.Local}
+	if schedule.Timezone != "" {
+		location, err := time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+		compiled.location = location
+	}
+
+	if len(schedule.Days) > 0 {
+		compiled.days = &[7]bool{}
+		for _, days := range schedule.Days {
+			if err := parseDays(days, compiled.days); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, window := range schedule.Times {
+		parsed, err := parseTimeWindow(window)
+		if err != nil {
+			return nil, err
+		}
+		compiled.windows = append(compiled.windows, parsed)
+	}
+
+	var err error
+	if compiled.from, err = parseDate(schedule.From); err != nil {
+		return nil, fmt.Errorf("invalid from date: %w", err)
+	}
+	if compiled.until, err = parseDate(schedule.Until); err != nil {
+		return nil, fmt.Errorf("invalid until date: %w", err)
+	}
+	if compiled.from != 0 && compiled.until != 0 && compiled.until < compiled.from {
+		return nil, fmt.Errorf("until %s is before from %s", schedule.Until, schedule.From)
+	}
+	return compiled, nil
+}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) >= 3 {
+		if day, ok := weekdays[name[:3]]; ok && strings.HasPrefix(strings.ToLower(day.String()), name) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", name)
+}
+
+// parseDays sets the days in a single day or a range such as fri-mon
+func parseDays(days string, set *[7]bool) error {
+	first, last, isRange := strings.Cut(days, "-")
+	from, err := parseWeekday(first)
+	if err != nil {
+		return err
+	}
+	to := from
+	if isRange {
+		if to, err = parseWeekday(last); err != nil {
+			return err
+		}
+	}
+
+	for day := from; ; day = (day + 1) % 7 {
+		set[day] = true
+		if day == to {
+			return nil
+		}
+	}
+}
+
+func parseTimeWindow(window string) (timeWindow, error) {
+	start, end, ok := strings.Cut(window, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("invalid time window %q, expected hh:mm-hh:mm", window)
+	}
+
+	var parsed timeWindow
+	var err error
+	if parsed.start, err = parseClockTime(start); err != nil || parsed.start == 24*60 {
+		return parsed, fmt.Errorf("invalid time window %q", window)
+	}
+	if parsed.end, err = parseClockTime(end); err != nil || parsed.end == parsed.start {
+		return parsed, fmt.Errorf("invalid time window %q", window)
+	}
+	return parsed, nil
+}
+
+// parseClockTime returns the minutes since midnight of hh:mm, 24:00 is the end of the day
+func parseClockTime(value string) (int, error) {
+	hours, minutes, ok := strings.Cut(strings.TrimSpace(value), ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil {
+		return 0, err
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return h*60 + m, nil
+}
+
+func parseDate(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	date, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return 0, err
+	}
+	return dateNumber(date), nil
+}
+
+func dateNumber(t time.Time) int {
+	year, month, day := t.Date()
+	return year*10000 + int(month)*100 + day
+}
+
+// match reports whether now is within the schedule, a window running past midnight belongs to the day it starts on
+func (s *compiledSchedule) match(now time.Time) bool {
+	now = now.In(s.location)
+	if date := dateNumber(now); (s.from != 0 && date < s.from) || (s.until != 0 && date > s.until) {
+		return false
+	}
+
+	if len(s.windows) == 0 {
+		return s.onDay(now.Weekday())
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	yesterday := (now.Weekday() + 6) % 7
+	for _, window := range s.windows {
+		if window.start < window.end {
+			if minute >= window.start && minute < window.end && s.onDay(now.Weekday()) {
+				return true
+			}
+			continue
+		}
+		if (minute >= window.start && s.onDay(now.Weekday())) || (minute < window.end && s.onDay(yesterday)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *compiledSchedule) onDay(day time.Weekday) bool {
+	return s.days == nil || s.days[day]
+}
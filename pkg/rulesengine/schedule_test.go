@@ -0,0 +1,121 @@
+package rulesengine
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestScheduleMatch(t *testing.T) {
+	// 2025-06-02 is a Monday
+	at := func(date string, clock string) time.Time {
+		t.Helper()
+		parsed, err := time.Parse("2006-01-02 15:04", date+" "+clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		now      time.Time
+		want     bool
+	}{
+		{name: "inside window", schedule: Schedule{Times: StringList{"09:00-17:00"}}, now: at("2025-06-02", "09:00"), want: true},
+		{name: "window end is exclusive", schedule: Schedule{Times: StringList{"09:00-17:00"}}, now: at("2025-06-02", "17:00"), want: false},
+		{name: "before window", schedule: Schedule{Times: StringList{"09:00-17:00"}}, now: at("2025-06-02", "08:59"), want: false},
+		{name: "window to end of day", schedule: Schedule{Times: StringList{"18:00-24:00"}}, now: at("2025-06-02", "23:59"), want: true},
+		{name: "second window", schedule: Schedule{Times: StringList{"08:00-09:00", "12:00-13:00"}}, now: at("2025-06-02", "12:30"), want: true},
+
+		{name: "past midnight before midnight", schedule: Schedule{Times: StringList{"22:00-06:00"}}, now: at("2025-06-02", "23:00"), want: true},
+		{name: "past midnight after midnight", schedule: Schedule{Times: StringList{"22:00-06:00"}}, now: at("2025-06-03", "05:59"), want: true},
+		{name: "past midnight outside", schedule: Schedule{Times: StringList{"22:00-06:00"}}, now: at("2025-06-03", "06:00"), want: false},
+		{
+			name:     "past midnight belongs to the day it starts",
+			schedule: Schedule{Days: StringList{"fri"}, Times: StringList{"22:00-02:00"}},
+			now:      at("2025-06-07", "01:00"), // saturday morning
+			want:     true,
+		},
+		{
+			name:     "past midnight not started the day before",
+			schedule: Schedule{Days: StringList{"fri"}, Times: StringList{"22:00-02:00"}},
+			now:      at("2025-06-06", "01:00"), // friday morning, thursday is not scheduled
+			want:     false,
+		},
+
+		{name: "weekday range", schedule: Schedule{Days: StringList{"mon-fri"}}, now: at("2025-06-06", "12:00"), want: true},
+		{name: "weekend outside weekday range", schedule: Schedule{Days: StringList{"mon-fri"}}, now: at("2025-06-07", "12:00"), want: false},
+		{name: "range wrapping the week", schedule: Schedule{Days: StringList{"fri-mon"}}, now: at("2025-06-08", "12:00"), want: true},
+		{name: "outside range wrapping the week", schedule: Schedule{Days: StringList{"fri-mon"}}, now: at("2025-06-04", "12:00"), want: false},
+		{name: "full day names", schedule: Schedule{Days: StringList{"Monday"}}, now: at("2025-06-02", "12:00"), want: true},
+
+		{name: "on from date", schedule: Schedule{From: "2025-06-02"}, now: at("2025-06-02", "00:00"), want: true},
+		{name: "before from date", schedule: Schedule{From: "2025-06-02"}, now: at("2025-06-01", "23:59"), want: false},
+		{name: "on until date", schedule: Schedule{Until: "2025-06-02"}, now: at("2025-06-02", "23:59"), want: true},
+		{name: "after until date", schedule: Schedule{Until: "2025-06-02"}, now: at("2025-06-03", "00:00"), want: false},
+		{name: "inside date range", schedule: Schedule{From: "2025-06-01", Until: "2025-06-30"}, now: at("2025-06-15", "12:00"), want: true},
+		{
+			name:     "date range and window",
+			schedule: Schedule{From: "2025-06-01", Until: "2025-06-30", Times: StringList{"09:00-17:00"}},
+			now:      at("2025-07-01", "10:00"),
+			want:     false,
+		},
+
+		{
+			name:     "timezone",
+			schedule: Schedule{Timezone: "Pacific/Auckland", Times: StringList{"09:00-17:00"}},
+			now:      at("2025-06-02", "22:00"), // 10:00 on tuesday in New Zealand
+			want:     true,
+		},
+		{
+			name:     "timezone weekday",
+			schedule: Schedule{Timezone: "Pacific/Auckland", Days: StringList{"mon"}},
+			now:      at("2025-06-02", "22:00"),
+			want:     false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule := test.schedule
+			if schedule.Timezone == "" {
+				schedule.Timezone = "UTC"
+			}
+			compiled, err := compileSchedule(&schedule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := compiled.match(test.now); got != test.want {
+				t.Errorf("got %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompileScheduleErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+	}{
+		{name: "unknown day", schedule: Schedule{Days: StringList{"funday"}}},
+		{name: "short day", schedule: Schedule{Days: StringList{"mo"}}},
+		{name: "window without end", schedule: Schedule{Times: StringList{"09:00"}}},
+		{name: "empty window", schedule: Schedule{Times: StringList{"09:00-09:00"}}},
+		{name: "window starting at 24:00", schedule: Schedule{Times: StringList{"24:00-06:00"}}},
+		{name: "invalid minutes", schedule: Schedule{Times: StringList{"09:60-10:00"}}},
+		{name: "past end of day", schedule: Schedule{Times: StringList{"09:00-24:30"}}},
+		{name: "invalid date", schedule: Schedule{From: "2025-13-01"}},
+		{name: "until before from", schedule: Schedule{From: "2025-06-02", Until: "2025-06-01"}},
+		{name: "unknown timezone", schedule: Schedule{Timezone: "Mars/Olympus_Mons"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := compileSchedule(&test.schedule); err == nil {
+				t.Error("schedule accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package rulesengine
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import "strings"
+
+// domainTrie indexes the domain and exact targets of every rule, including those from lists, by their labels from the
+// top level domain down. matching a hostname walks its labels once however many hostnames the rules hold
+type domainTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	// rules matching this domain and its subdomains
+	domainRules []int
+	// rules matching this hostname only
+	exactRules []int
+}
+
+// add indexes host as a target of the rule at index rule, exact targets do not match subdomains
+func (t *domainTrie) add(host string, rule int, exact bool) {
+	node := &t.root
+	for host != "" {
+		var label string
+		label, host = lastLabel(host)
+
+		child := node.children[label]
+		if child == nil {
+			if node.children == nil {
+				node.children = map[string]*trieNode{}
+			}
+			child = &trieNode{}
+			// the label may be part of a much longer line read from a list
+			node.children[strings.Clone(label)] = child
+		}
+		node = child
+	}
+
+	if exact {
+		node.exactRules = appendRule(node.exactRules, rule)
+	} else {
+		node.domainRules = appendRule(node.domainRules, rule)
+	}
+}
+
+// rules are added in order so a target repeated by a rule is always the last one added
+func appendRule(rules []int, rule int) []int {
+	if n := len(rules); n > 0 && rules[n-1] == rule {
+		return rules
+	}
+	return append(rules, rule)
+}
+
+// match sets matched for the rules with a target matching host
+func (t *domainTrie) match(host string, matched []bool) {
+	node := &t.root
+	for host != "" {
+		var label string
+		label, host = lastLabel(host)
+
+		if node = node.children[label]; node == nil {
+			return
+		}
+		for _, rule := range node.domainRules {
+			matched[rule] = true
+		}
+	}
+	for _, rule := range node.exactRules {
+		matched[rule] = true
+	}
+}
+
+// lastLabel splits the last label from host
+func lastLabel(host string) (string, string) {
+	if i := strings.LastIndexByte(host, '.'); i >= 0 {
+		return host[i+1:], host[:i]
+	}
+	return host, ""
+}
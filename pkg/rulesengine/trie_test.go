@@ -0,0 +1,105 @@
+package rulesengine
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rhysbryant/proxylink/pkg/domainlist"
+)
+
+func TestDomainTrie(t *testing.T) {
+	var trie domainTrie
+	trie.add("example.com", 0, false)
+	trie.add("ads.example.com", 1, true)
+	trie.add("com", 2, false)
+	trie.add("localhost", 3, true)
+	trie.add("example.com", 4, true)
+	// repeated targets of a rule are only indexed once
+	trie.add("example.org", 5, false)
+	trie.add("example.org", 5, false)
+
+	tests := []struct {
+		host string
+		want []int
+	}{
+		{host: "example.com", want: []int{0, 2, 4}},
+		{host: "www.example.com", want: []int{0, 2}},
+		{host: "ads.example.com", want: []int{0, 1, 2}},
+		{host: "x.ads.example.com", want: []int{0, 2}},
+		{host: "notexample.com", want: []int{2}},
+		{host: "example.net", want: nil},
+		{host: "localhost", want: []int{3}},
+		{host: "sub.localhost", want: nil},
+		{host: "example.org", want: []int{5}},
+		{host: "", want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			matched := make([]bool, 6)
+			trie.match(test.host, matched)
+
+			var got []int
+			for rule, ok := range matched {
+				if ok {
+					got = append(got, rule)
+				}
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got rules %v want %v", got, test.want)
+			}
+		})
+	}
+
+	if rules := trie.root.children["org"].children["example"].domainRules; len(rules) != 1 {
+		t.Errorf("repeated target indexed %d times", len(rules))
+	}
+}
+
+func TestListRules(t *testing.T) {
+	list, err := domainlist.Parse(strings.NewReader("||ads.example.com^\n0.0.0.0 tracker.example.net\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []Rule{
+		{Name: "exact", Target: []string{"exact.example.org"}, Match: MatchExact},
+		{Name: "blocklist", Lists: []string{"ads"}, Block: true},
+		{Name: "suffix", Target: []string{"example.net"}, Match: MatchSuffix},
+	}
+	engine, err := NewRulesEngine(rules, ConnectPolicy{}, map[string]*domainlist.List{"ads": list}, GeoIP{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "ads.example.com", want: "blocklist"},
+		{host: "img.ads.example.com", want: "blocklist"},
+		{host: "tracker.example.net", want: "blocklist"},
+		// hosts file entries do not match subdomains
+		{host: "cdn.tracker.example.net", want: "suffix"},
+		{host: "exact.example.org", want: "exact"},
+		{host: "www.exact.example.org", want: DefaultRuleName},
+		{host: "example.com", want: DefaultRuleName},
+	}
+
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "http://"+test.host+"/", nil)
+			if got := engine.FindMatch(r).Name; got != test.want {
+				t.Errorf("matched %q want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnknownList(t *testing.T) {
+	_, err := NewRulesEngine([]Rule{{Lists: []string{"missing"}}}, ConnectPolicy{}, nil, GeoIP{})
+	if err == nil {
+		t.Error("rule with an unknown list accepted")
+	}
+}
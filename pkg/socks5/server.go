@@ -0,0 +1,427 @@
+package socks5
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* A SOCKS5 (RFC 1928) front end for the proxy pipeline.
+
+SOCKS CONNECT requests are translated into HTTP CONNECT requests and passed to the same
+httputils.RequestProcessor the HTTP listener uses, so rules and providers apply identically.
+UDP ASSOCIATE is supported when the processor also implements udprelay.Dialer.
+
+*/
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rhysbryant/proxylink/pkg/httputils"
+)
+
+const (
+	socksVersion = 0x05
+
+	authNone         = 0x00
+	authUserPass     = 0x02
+	authNoAcceptable = 0xFF
+
+	userPassVersion = 0x01
+
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+
+	addrIPv4   = 0x01
+	addrDomain = 0x03
+	addrIPv6   = 0x04
+
+	replySucceeded          = 0x00
+	replyGeneralFailure     = 0x01
+	replyNotAllowed         = 0x02
+	replyHostUnreachable    = 0x04
+	replyCommandUnsupported = 0x07
+	replyAddressUnsupported = 0x08
+
+	handshakeTimeout = 30 * time.Second
+)
+
+// CredentialStore checks SOCKS username/password credentials
+type CredentialStore interface {
+	Valid(username, password string) bool
+}
+
+// StaticCredentials is a CredentialStore backed by a map of username to password
+type StaticCredentials map[string]string
+
+func (c StaticCredentials) Valid(username, password string) bool {
+	expected, ok := c[username]
+	// the password is compared even for unknown users so the time taken does not reveal which users exist
+	match := subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+	return ok && match
+}
+
+type Server struct {
+	processor   httputils.RequestProcessor
+	credentials CredentialStore
+
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+// NewServer returns a SOCKS5 server that feeds requests into processor,
+// if credentials is nil clients are not asked to authenticate
+func NewServer(processor httputils.RequestProcessor, credentials CredentialStore) *Server {
+	return &Server{processor: processor, credentials: credentials}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener until it is closed
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	reader := bufio.NewReader(conn)
+
+	user, err := s.negotiateAuth(reader, conn)
+	if err != nil {
+		slog.Info("socks handshake failed", "error", err, "from", conn.RemoteAddr())
+		return
+	}
+
+	command, target, err := s.readRequest(reader, conn)
+	if err != nil {
+		slog.Info("socks request failed", "error", err, "from", conn.RemoteAddr())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if command == cmdUDPAssociate {
+		if err := s.handleAssociate(conn, reader, user); err != nil {
+			slog.Info("socks udp association failed", "error", err, "from", conn.RemoteAddr())
+		}
+		return
+	}
+
+	r := newRequest(http.MethodConnect, target, conn.RemoteAddr().String(), user)
+
+	w := httputils.NewStatusResponseWriter(&bufferedConn{Conn: conn, reader: reader}, func(status int) error {
+		return writeReply(conn, replyForStatus(status))
+	})
+
+	if err := s.processor.ProcessRequest(r, w); err != nil {
+		slog.Debug("socks request error", "error", err, "target", target)
+	}
+
+	if w.Status() == 0 {
+		writeReply(conn, replyGeneralFailure)
+	}
+}
+
+// newRequest builds the request passed down the pipeline for a SOCKS command
+func newRequest(method string, target string, remoteAddr string, user string) *http.Request {
+	r := &http.Request{
+		Method:     method,
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		RemoteAddr: remoteAddr,
+	}
+	r = r.WithContext(context.Background())
+	if user != "" {
+		r = httputils.WithUser(r, user)
+	}
+	return r
+}
+
+// negotiateAuth handles the method selection message and optional username/password sub negotiation,
+// it returns the authenticated username or an empty string when authentication is disabled
+func (s *Server) negotiateAuth(reader *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+
+	wanted := byte(authNone)
+	if s.credentials != nil {
+		wanted = authUserPass
+	}
+
+	offered := false
+	for _, method := range methods {
+		if method == wanted {
+			offered = true
+			break
+		}
+	}
+
+	if !offered {
+		conn.Write([]byte{socksVersion, authNoAcceptable})
+		return "", errors.New("no acceptable authentication method offered")
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, wanted}); err != nil {
+		return "", err
+	}
+
+	if wanted == authUserPass {
+		return s.authenticate(reader, conn)
+	}
+
+	return "", nil
+}
+
+// authenticate performs RFC 1929 username/password authentication
+func (s *Server) authenticate(reader *bufio.Reader, conn net.Conn) (string, error) {
+	version, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if version != userPassVersion {
+		return "", fmt.Errorf("unsupported auth version %d", version)
+	}
+
+	username, err := readString(reader)
+	if err != nil {
+		return "", err
+	}
+	password, err := readString(reader)
+	if err != nil {
+		return "", err
+	}
+
+	if !s.credentials.Valid(username, password) {
+		conn.Write([]byte{userPassVersion, 0x01})
+		return "", fmt.Errorf("invalid credentials for user %q", username)
+	}
+
+	if _, err := conn.Write([]byte{userPassVersion, 0x00}); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// readRequest reads the client request and returns the command and target as host:port
+func (s *Server) readRequest(reader *bufio.Reader, conn net.Conn) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socksVersion {
+		return 0, "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	host, port, err := readAddress(reader)
+	if err != nil {
+		if errors.Is(err, errAddressType) {
+			writeReply(conn, replyAddressUnsupported)
+		}
+		return 0, "", err
+	}
+
+	if header[1] != cmdConnect && header[1] != cmdUDPAssociate {
+		writeReply(conn, replyCommandUnsupported)
+		return 0, "", fmt.Errorf("unsupported command %d", header[1])
+	}
+
+	return header[1], net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+var errAddressType = errors.New("unsupported address type")
+
+func readAddress(reader io.ByteReader) (string, int, error) {
+	addrType, err := reader.ReadByte()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var host string
+	switch addrType {
+	case addrIPv4, addrIPv6:
+		size := net.IPv4len
+		if addrType == addrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if err := readFull(reader, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case addrDomain:
+		host, err = readString(reader)
+		if err != nil {
+			return "", 0, err
+		}
+	default:
+		return "", 0, fmt.Errorf("%w %d", errAddressType, addrType)
+	}
+
+	port := make([]byte, 2)
+	if err := readFull(reader, port); err != nil {
+		return "", 0, err
+	}
+
+	return host, int(port[0])<<8 | int(port[1]), nil
+}
+
+func readFull(reader io.ByteReader, buf []byte) error {
+	for i := range buf {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		buf[i] = b
+	}
+	return nil
+}
+
+// readString reads a single length prefixed string
+func readString(reader io.ByteReader) (string, error) {
+	size, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	value := make([]byte, size)
+	if err := readFull(reader, value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// appendAddress encodes host:port in SOCKS address form
+func appendAddress(buf []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, addrIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, addrIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		buf = append(buf, addrDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+// writeReply sends a reply with an unspecified bind address
+func writeReply(w io.Writer, reply byte) error {
+	return writeReplyWithAddress(w, reply, "0.0.0.0:0")
+}
+
+func writeReplyWithAddress(w io.Writer, reply byte, bindAddr string) error {
+	buf, err := appendAddress([]byte{socksVersion, reply, 0x00}, bindAddr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func replyForStatus(status int) byte {
+	switch {
+	case status >= 200 && status < 300:
+		return replySucceeded
+	case status == http.StatusForbidden, status == http.StatusProxyAuthRequired:
+		return replyNotAllowed
+	case status == http.StatusGatewayTimeout, status == http.StatusServiceUnavailable:
+		return replyHostUnreachable
+	default:
+		return replyGeneralFailure
+	}
+}
+
+// bufferedConn reads through the handshake reader so bytes the client sent early are not lost
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,223 @@
+package socks5
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/rhysbryant/proxylink/pkg/udprelay"
+)
+
+// handleAssociate serves a UDP ASSOCIATE command, the association lasts until the control connection closes
+func (s *Server) handleAssociate(conn net.Conn, reader *bufio.Reader, user string) error {
+	dialer, ok := s.processor.(udprelay.Dialer)
+	if !ok {
+		writeReply(conn, replyCommandUnsupported)
+		return errors.New("udp relay not supported by the request processor")
+	}
+
+	localAddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	remoteAddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if localAddr == nil || remoteAddr == nil {
+		writeReply(conn, replyGeneralFailure)
+		return errors.New("udp association requires a tcp control connection")
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		writeReply(conn, replyGeneralFailure)
+		return fmt.Errorf("failed to open udp socket: %w", err)
+	}
+	defer udpConn.Close()
+
+	if err := writeReplyWithAddress(conn, replySucceeded, udpConn.LocalAddr().String()); err != nil {
+		return err
+	}
+
+	go func() {
+		// the client keeps the control connection open for as long as it wants the association
+		io.Copy(io.Discard, reader)
+		udpConn.Close()
+	}()
+
+	assoc := &association{
+		dialer:     dialer,
+		udpConn:    udpConn,
+		clientIP:   remoteAddr.IP,
+		remoteAddr: conn.RemoteAddr().String(),
+		user:       user,
+		relays:     map[string]udprelay.Conn{},
+	}
+	defer assoc.close()
+
+	assoc.serve()
+	return nil
+}
+
+// association relays datagrams for one SOCKS client, each destination gets its own relay connection
+type association struct {
+	dialer     udprelay.Dialer
+	udpConn    *net.UDPConn
+	clientIP   net.IP
+	remoteAddr string
+	user       string
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr
+	relays     map[string]udprelay.Conn
+}
+
+func (a *association) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		// only the client that requested the association may use it
+		if !from.IP.Equal(a.clientIP) {
+			continue
+		}
+
+		a.mu.Lock()
+		if a.clientAddr == nil {
+			a.clientAddr = from
+		}
+		a.mu.Unlock()
+
+		target, data, err := parseDatagram(buf[:n])
+		if err != nil {
+			slog.Debug("dropping socks datagram", "error", err, "from", from)
+			continue
+		}
+
+		relay, err := a.relayFor(target)
+		if err != nil {
+			slog.Info("failed to open udp relay", "error", err, "target", target)
+			continue
+		}
+
+		if _, err := relay.WriteDatagram(data, target); err != nil {
+			slog.Debug("failed to relay datagram", "error", err, "target", target)
+			a.removeRelay(target, relay)
+		}
+	}
+}
+
+// relayFor returns the relay for target, dialing one if needed.
+// the dial happens without holding the lock so replies for other targets are not held up
+func (a *association) relayFor(target string) (udprelay.Conn, error) {
+	a.mu.Lock()
+	relay, ok := a.relays[target]
+	a.mu.Unlock()
+	if ok {
+		return relay, nil
+	}
+
+	relay, err := a.dialer.DialPacket(newRequest(udprelay.MethodAssociate, target, a.remoteAddr, a.user))
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	if existing, ok := a.relays[target]; ok {
+		// another relay was opened for the target while dialing
+		a.mu.Unlock()
+		relay.Close()
+		return existing, nil
+	}
+	a.relays[target] = relay
+	a.mu.Unlock()
+
+	go a.forwardReplies(target, relay)
+	return relay, nil
+}
+
+// forwardReplies sends datagrams from the relay back to the client until the relay closes
+func (a *association) forwardReplies(target string, relay udprelay.Conn) {
+	defer a.removeRelay(target, relay)
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := relay.ReadDatagram(buf)
+		if err != nil {
+			return
+		}
+
+		packet, err := appendAddress([]byte{0, 0, 0}, from)
+		if err != nil {
+			continue
+		}
+		packet = append(packet, buf[:n]...)
+
+		a.mu.Lock()
+		clientAddr := a.clientAddr
+		a.mu.Unlock()
+
+		if _, err := a.udpConn.WriteToUDP(packet, clientAddr); err != nil {
+			return
+		}
+	}
+}
+
+func (a *association) removeRelay(target string, relay udprelay.Conn) {
+	a.mu.Lock()
+	if a.relays[target] == relay {
+		delete(a.relays, target)
+	}
+	a.mu.Unlock()
+	relay.Close()
+}
+
+func (a *association) close() {
+	a.mu.Lock()
+	relays := a.relays
+	a.relays = map[string]udprelay.Conn{}
+	a.mu.Unlock()
+
+	for _, relay := range relays {
+		relay.Close()
+	}
+}
+
+// parseDatagram decodes the SOCKS UDP request header and returns the destination and payload
+func parseDatagram(packet []byte) (string, []byte, error) {
+	if len(packet) < 4 {
+		return "", nil, errors.New("datagram too short")
+	}
+	if packet[2] != 0 {
+		return "", nil, errors.New("fragmented datagrams are not supported")
+	}
+
+	reader := bytes.NewReader(packet[3:])
+	host, port, err := readAddress(reader)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), packet[len(packet)-reader.Len():], nil
+}
@@ -0,0 +1,119 @@
+//go:build linux
+
+package transparent
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST from linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+	ipTransparent     = 19 // IP_TRANSPARENT from linux/in.h
+	ipv6Transparent   = 75 // IPV6_TRANSPARENT from linux/in6.h
+)
+
+// originalDestination returns the address a REDIRECTed connection was originally sent to
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a tcp connection")
+	}
+
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	isIPv4 := local != nil && local.IP.To4() != nil
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if isIPv4 {
+			// the kernel fills a sockaddr_in, ipv6_mreq is just a buffer large enough to hold it
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			raw := mreq.Multiaddr
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]),
+				Port: int(binary.BigEndian.Uint16(raw[2:4])),
+			}
+			return
+		}
+
+		// the kernel fills a sockaddr_in6, ip6_mtuinfo starts with one
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tSoOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		port := make([]byte, 2)
+		binary.NativeEndian.PutUint16(port, info.Addr.Port)
+		addr = &net.TCPAddr{
+			IP:   net.IP(info.Addr.Addr[:]),
+			Port: int(binary.BigEndian.Uint16(port)),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", sockErr)
+	}
+
+	return addr, nil
+}
+
+// listenConfig returns a listen config, marking the socket transparent for TPROXY
+func listenConfig(tproxy bool) (net.ListenConfig, error) {
+	if !tproxy {
+		return net.ListenConfig{}, nil
+	}
+
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					// dual stack sockets need both options to accept ipv4 and ipv6 traffic
+					if sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Transparent, 1); sockErr != nil {
+						return
+					}
+				}
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipTransparent, 1)
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("failed to set IP_TRANSPARENT (requires CAP_NET_ADMIN): %w", sockErr)
+			}
+			return nil
+		},
+	}, nil
+}
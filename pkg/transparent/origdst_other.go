@@ -0,0 +1,30 @@
+//go:build !linux
+
+package transparent
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import "net"
+
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
+
+func listenConfig(tproxy bool) (net.ListenConfig, error) {
+	return net.ListenConfig{}, ErrUnsupported
+}
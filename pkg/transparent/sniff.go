@@ -0,0 +1,109 @@
+package transparent
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// how long to wait for the client to speak first, protocols where the server speaks first fall back to the IP address
+	sniffTimeout = time.Second
+
+	tlsHandshakeRecord = 0x16
+)
+
+var errSniffed = errors.New("client hello captured")
+
+// sniffHostname looks for a TLS SNI or HTTP Host header at the start of the connection.
+// the returned connection replays every byte read while sniffing
+func sniffHostname(conn net.Conn) (string, net.Conn) {
+	reader := bufio.NewReader(conn)
+	var recorded bytes.Buffer
+	recording := io.TeeReader(reader, &recorded)
+
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var hostname string
+	if first, err := reader.Peek(1); err == nil {
+		if first[0] == tlsHandshakeRecord {
+			hostname = sniffSNI(recording)
+		} else {
+			hostname = sniffHTTPHost(recording)
+		}
+	}
+
+	return hostname, &replayConn{Conn: conn, reader: io.MultiReader(&recorded, reader)}
+}
+
+func sniffSNI(r io.Reader) string {
+	var serverName string
+	tls.Server(&readOnlyConn{reader: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errSniffed
+		},
+	}).Handshake()
+
+	return serverName
+}
+
+func sniffHTTPHost(r io.Reader) string {
+	req, err := http.ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		return ""
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// replayConn reads from reader before the underlying connection
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// readOnlyConn feeds the TLS stack the client hello without letting it reply
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,160 @@
+package transparent
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* A transparent proxy listener for connections redirected by iptables/nftables.
+
+with REDIRECT the original destination is recovered with SO_ORIGINAL_DST, with TPROXY the
+listener socket is marked IP_TRANSPARENT and the local address of the connection is the original destination.
+the TLS SNI or HTTP Host header is sniffed so rules can match on the hostname, then the connection
+is passed down the pipeline as a CONNECT request.
+
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/rhysbryant/proxylink/pkg/httputils"
+)
+
+var ErrUnsupported = errors.New("transparent proxy mode is only supported on linux")
+
+type Server struct {
+	processor httputils.RequestProcessor
+	tproxy    bool
+
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+// NewServer returns a transparent proxy server that feeds connections into processor,
+// set tproxy when traffic is delivered with the TPROXY target instead of REDIRECT
+func NewServer(processor httputils.RequestProcessor, tproxy bool) *Server {
+	return &Server{processor: processor, tproxy: tproxy}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	lc, err := listenConfig(s.tproxy)
+	if err != nil {
+		return err
+	}
+
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener until it is closed
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *Server) destination(conn net.Conn) (*net.TCPAddr, error) {
+	if s.tproxy {
+		addr, ok := conn.LocalAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("unexpected local address %s", conn.LocalAddr())
+		}
+		return addr, nil
+	}
+	return originalDestination(conn)
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	dst, err := s.destination(conn)
+	if err != nil {
+		slog.Info("failed to get original destination", "error", err, "from", conn.RemoteAddr())
+		return
+	}
+
+	// a connection made straight to the listener would loop back into the proxy
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && !s.tproxy && local.IP.Equal(dst.IP) && local.Port == dst.Port {
+		slog.Info("refusing connection addressed to the transparent listener itself", "from", conn.RemoteAddr())
+		return
+	}
+
+	hostname, sniffedConn := sniffHostname(conn)
+
+	host := dst.IP.String()
+	if hostname != "" {
+		host = hostname
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(dst.Port))
+
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	r = r.WithContext(context.Background())
+
+	// the client thinks it is talking to the target, so there is nobody to tell about a failure
+	w := httputils.NewStatusResponseWriter(sniffedConn, func(status int) error {
+		if status < 200 || status > 299 {
+			return conn.Close()
+		}
+		return nil
+	})
+
+	if err := s.processor.ProcessRequest(r, w); err != nil {
+		slog.Debug("transparent request error", "error", err, "target", target, "originalDestination", dst)
+	}
+}
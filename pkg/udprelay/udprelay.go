@@ -0,0 +1,238 @@
+package udprelay
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* UDP datagram relay.
+
+a UDP association is requested over a tunnel stream with an HTTP request using MethodAssociate,
+after a 200 response both sides exchange datagrams framed as
+
+	addrLen uint8
+	addr    host:port (addrLen bytes)
+	dataLen uint16 (big endian)
+	data
+
+the address is the destination when sent towards the exit node and the source of the reply when sent back.
+
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rhysbryant/proxylink/pkg/netpolicy"
+)
+
+// MethodAssociate is the request method used to ask the next proxy for a UDP association
+const MethodAssociate = "UDP-ASSOCIATE"
+
+// DefaultIdleTimeout is how long a UDP association may be unused before it is closed
+const DefaultIdleTimeout = 60 * time.Second
+
+const maxDatagramSize = 65535
+
+var ErrIdleTimeout = errors.New("udp association idle timeout")
+
+// Conn is a datagram connection that can reach any address
+type Conn interface {
+	// ReadDatagram reads the next datagram and the address it came from
+	ReadDatagram(p []byte) (n int, addr string, err error)
+	// WriteDatagram sends a datagram to addr (host:port)
+	WriteDatagram(p []byte, addr string) (int, error)
+	Close() error
+}
+
+// Dialer is implemented by request processors that can relay UDP.
+// the request carries the destination in URL.Host and the client in RemoteAddr so it can be routed like a CONNECT
+type Dialer interface {
+	DialPacket(r *http.Request) (Conn, error)
+}
+
+// Pipe relays datagrams between a and b in both directions until either side fails, both are closed on return
+func Pipe(a, b Conn) error {
+	errs := make(chan error, 2)
+
+	relay := func(dst, src Conn) {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := src.ReadDatagram(buf)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := dst.WriteDatagram(buf[:n], addr); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}
+
+	go relay(a, b)
+	go relay(b, a)
+
+	err := <-errs
+	a.Close()
+	b.Close()
+	<-errs
+
+	if errors.Is(err, io.EOF) || errors.Is(err, ErrIdleTimeout) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// streamConn carries framed datagrams over a stream
+type streamConn struct {
+	rw      io.ReadWriteCloser
+	writeMu sync.Mutex
+	header  [1]byte
+}
+
+// NewStreamConn returns a Conn that frames datagrams over rw
+func NewStreamConn(rw io.ReadWriteCloser) Conn {
+	return &streamConn{rw: rw}
+}
+
+func (c *streamConn) ReadDatagram(p []byte) (int, string, error) {
+	if _, err := io.ReadFull(c.rw, c.header[:]); err != nil {
+		return 0, "", err
+	}
+
+	addr := make([]byte, c.header[0])
+	if _, err := io.ReadFull(c.rw, addr); err != nil {
+		return 0, "", err
+	}
+
+	var size uint16
+	if err := binary.Read(c.rw, binary.BigEndian, &size); err != nil {
+		return 0, "", err
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.rw, data); err != nil {
+		return 0, "", err
+	}
+
+	return copy(p, data), string(addr), nil
+}
+
+func (c *streamConn) WriteDatagram(p []byte, addr string) (int, error) {
+	if len(addr) > 255 {
+		return 0, fmt.Errorf("address too long: %s", addr)
+	}
+	if len(p) > maxDatagramSize {
+		return 0, fmt.Errorf("datagram of %d bytes too large", len(p))
+	}
+
+	frame := make([]byte, 0, 1+len(addr)+2+len(p))
+	frame = append(frame, byte(len(addr)))
+	frame = append(frame, addr...)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(p)))
+	frame = append(frame, p...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if _, err := c.rw.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *streamConn) Close() error {
+	return c.rw.Close()
+}
+
+// directConn sends datagrams straight to their destination from a local UDP socket
+type directConn struct {
+	conn         *net.UDPConn
+	idleTimeout  time.Duration
+	policy       *netpolicy.Policy
+	lastActivity atomic.Int64
+}
+
+// ListenDirect opens a local UDP socket for relaying to any destination policy allows, a nil policy allows all.
+// reads fail with ErrIdleTimeout once no datagrams have passed in either direction for idleTimeout
+func ListenDirect(idleTimeout time.Duration, policy *netpolicy.Policy) (Conn, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open udp socket: %w", err)
+	}
+
+	c := &directConn{conn: conn, idleTimeout: idleTimeout, policy: policy}
+	c.touch()
+	return c, nil
+}
+
+func (c *directConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *directConn) ReadDatagram(p []byte) (int, string, error) {
+	for {
+		c.conn.SetReadDeadline(time.Unix(0, c.lastActivity.Load()).Add(c.idleTimeout))
+
+		n, addr, err := c.conn.ReadFromUDP(p)
+		if err == nil {
+			c.touch()
+			return n, addr.String(), nil
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if time.Since(time.Unix(0, c.lastActivity.Load())) >= c.idleTimeout {
+				return 0, "", ErrIdleTimeout
+			}
+			// a write kept the association alive
+			continue
+		}
+		return 0, "", err
+	}
+}
+
+func (c *directConn) WriteDatagram(p []byte, addr string) (int, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve %s: %w", addr, err)
+	}
+
+	if c.policy != nil {
+		if err := c.policy.Check(udpAddr.AddrPort()); err != nil {
+			// dropped like any other undeliverable datagram so the rest of the association carries on
+			slog.Debug("udp datagram dropped", "destination", addr, "error", err)
+			return len(p), nil
+		}
+	}
+
+	c.touch()
+	return c.conn.WriteToUDP(p, udpAddr)
+}
+
+func (c *directConn) Close() error {
+	return c.conn.Close()
+}
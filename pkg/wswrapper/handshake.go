@@ -0,0 +1,205 @@
+package wswrapper
+
+/*
+ Copyright (c) 2025 Rhys Bryant
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/**
+
+* Authenticated key exchange between the bridge and the exit node.
+
+both sides generate an ephemeral X25519 key pair and mix the shared secret with the pre-shared key to derive a
+key for this session only, so recorded traffic cannot be decrypted later even if the pre-shared key leaks.
+knowledge of the pre-shared key is proven in both directions before any traffic is sent.
+
+	initiator -> responder  version(1) | initiator ephemeral public key(32)
+	responder -> initiator  responder ephemeral public key(32) | HMAC(responder confirm key, transcript)
+	initiator -> responder  HMAC(initiator confirm key, transcript)
+
+keys are derived with HKDF-SHA256 using the pre-shared key as the salt and the DH output as the secret.
+
+*/
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HandshakeHeader is sent by bridges that support the key exchange, the exit node echoes it back when it agrees
+const HandshakeHeader = "X-Proxylink-Handshake"
+
+// HandshakeX25519PSK identifies the X25519 key exchange authenticated with the pre-shared key
+const HandshakeX25519PSK = "x25519-psk-v1"
+
+const (
+	handshakeVersion = 1
+	handshakeTimeout = 10 * time.Second
+	publicKeySize    = 32
+	macSize          = sha256.Size
+)
+
+var ErrHandshakeFailed = errors.New("key exchange failed, the peer does not hold the same key")
+
+type sessionKeys struct {
+	session          [32]byte
+	initiatorConfirm []byte
+	responderConfirm []byte
+}
+
+func deriveSessionKeys(psk [32]byte, sharedSecret []byte, initiatorPublic []byte, responderPublic []byte) (*sessionKeys, error) {
+	info := []byte(HandshakeX25519PSK)
+	info = append(info, initiatorPublic...)
+	info = append(info, responderPublic...)
+
+	material, err := hkdf.Key(sha256.New, sharedSecret, psk[:], string(info), 96)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &sessionKeys{initiatorConfirm: material[32:64], responderConfirm: material[64:96]}
+	copy(keys.session[:], material[:32])
+	return keys, nil
+}
+
+func confirmation(key []byte, role string, initiatorPublic []byte, responderPublic []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(role))
+	mac.Write(initiatorPublic)
+	mac.Write(responderPublic)
+	return mac.Sum(nil)
+}
+
+func readHandshakeMessage(conn *websocket.Conn, size int) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handshake message: %w", err)
+	}
+	if len(msg) != size {
+		return nil, fmt.Errorf("unexpected handshake message length %d", len(msg))
+	}
+	return msg, nil
+}
+
+// NewWSConnWithHandshake runs the key exchange over conn and returns the connection encrypted with the derived session key
+func NewWSConnWithHandshake(conn *websocket.Conn, psk [32]byte, initiator bool) (io.ReadWriteCloser, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	localPublic := ephemeral.PublicKey().Bytes()
+
+	var keys *sessionKeys
+	if initiator {
+		keys, err = initiatorHandshake(conn, psk, ephemeral, localPublic)
+	} else {
+		keys, err = responderHandshake(conn, psk, ephemeral, localPublic)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newEncryptedConn(NewWSConn(conn), keys.session, initiator, true), nil
+}
+
+func initiatorHandshake(conn *websocket.Conn, psk [32]byte, ephemeral *ecdh.PrivateKey, localPublic []byte) (*sessionKeys, error) {
+	hello := append([]byte{handshakeVersion}, localPublic...)
+	if err := conn.WriteMessage(websocket.BinaryMessage, hello); err != nil {
+		return nil, fmt.Errorf("failed to send handshake: %w", err)
+	}
+
+	reply, err := readHandshakeMessage(conn, publicKeySize+macSize)
+	if err != nil {
+		return nil, err
+	}
+	remotePublic := reply[:publicKeySize]
+
+	keys, err := agree(psk, ephemeral, remotePublic, localPublic, remotePublic)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := confirmation(keys.responderConfirm, "responder", localPublic, remotePublic)
+	if !hmac.Equal(expected, reply[publicKeySize:]) {
+		return nil, ErrHandshakeFailed
+	}
+
+	finish := confirmation(keys.initiatorConfirm, "initiator", localPublic, remotePublic)
+	if err := conn.WriteMessage(websocket.BinaryMessage, finish); err != nil {
+		return nil, fmt.Errorf("failed to send handshake confirmation: %w", err)
+	}
+
+	return keys, nil
+}
+
+func responderHandshake(conn *websocket.Conn, psk [32]byte, ephemeral *ecdh.PrivateKey, localPublic []byte) (*sessionKeys, error) {
+	hello, err := readHandshakeMessage(conn, 1+publicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	if hello[0] != handshakeVersion {
+		return nil, fmt.Errorf("unsupported handshake version %d", hello[0])
+	}
+	remotePublic := hello[1:]
+
+	keys, err := agree(psk, ephemeral, remotePublic, remotePublic, localPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := append(append([]byte{}, localPublic...), confirmation(keys.responderConfirm, "responder", remotePublic, localPublic)...)
+	if err := conn.WriteMessage(websocket.BinaryMessage, reply); err != nil {
+		return nil, fmt.Errorf("failed to send handshake reply: %w", err)
+	}
+
+	finish, err := readHandshakeMessage(conn, macSize)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := confirmation(keys.initiatorConfirm, "initiator", remotePublic, localPublic)
+	if !hmac.Equal(expected, finish) {
+		return nil, ErrHandshakeFailed
+	}
+
+	return keys, nil
+}
+
+func agree(psk [32]byte, ephemeral *ecdh.PrivateKey, remotePublic []byte, initiatorPublic []byte, responderPublic []byte) (*sessionKeys, error) {
+	remoteKey, err := ecdh.X25519().NewPublicKey(remotePublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer public key: %w", err)
+	}
+
+	sharedSecret, err := ephemeral.ECDH(remoteKey)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %w", err)
+	}
+
+	return deriveSessionKeys(psk, sharedSecret, initiatorPublic, responderPublic)
+}
@@ -0,0 +1,113 @@
+package wswrapper
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialPair returns the two ends of a websocket connection, the first is the dialing side
+func dialPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		serverConn.Close()
+	})
+	return client, serverConn
+}
+
+func testKey(b byte) [32]byte {
+	var key [32]byte
+	for i := range key {
+		key[i] = b
+	}
+	return key
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name         string
+		initiatorKey [32]byte
+		responderKey [32]byte
+		wantErr      error
+	}{
+		{name: "same key", initiatorKey: testKey(1), responderKey: testKey(1)},
+		{name: "different keys", initiatorKey: testKey(1), responderKey: testKey(2), wantErr: ErrHandshakeFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			initiatorConn, responderConn := dialPair(t)
+
+			type result struct {
+				conn io.ReadWriteCloser
+				err  error
+			}
+			responded := make(chan result, 1)
+			go func() {
+				conn, err := NewWSConnWithHandshake(responderConn, test.responderKey, false)
+				responded <- result{conn, err}
+			}()
+
+			initiator, err := NewWSConnWithHandshake(initiatorConn, test.initiatorKey, true)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got error %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			responder := <-responded
+			if responder.err != nil {
+				t.Fatal(responder.err)
+			}
+
+			message := []byte("hello exit node")
+			go initiator.Write(message)
+			got := make([]byte, len(message))
+			if _, err := io.ReadFull(responder.conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(message) {
+				t.Errorf("got %q want %q", got, message)
+			}
+		})
+	}
+}
+
+func TestHandshakeRejectsPreSharedKeyPeer(t *testing.T) {
+	initiatorConn, responderConn := dialPair(t)
+
+	// a peer encrypting with the pre-shared key directly never sends a handshake reply the initiator accepts
+	go func() {
+		conn := NewWSConnWithEncryption(responderConn, testKey(1), false)
+		conn.Write([]byte("not a handshake"))
+	}()
+
+	if _, err := NewWSConnWithHandshake(initiatorConn, testKey(1), true); err == nil {
+		t.Fatal("handshake succeeded with a peer that does not support it")
+	}
+}
@@ -27,6 +27,9 @@ import (
 	stream "github.com/nknorg/encrypted-stream"
 )
 
+// KeyIDHeader carries the fingerprint of the key the bridge uses so the exit node can pick it from its keyring
+const KeyIDHeader = "X-Proxylink-Key-Id"
+
 // WSConn is a wrapper around websocket.Conn to implement io.ReadWriteCloser
 // this abstracts away the websocket message framing so the connection can be used as a Stream implementation of io.ReadWriteCloser
 type WSConn struct {
@@ -40,11 +43,15 @@ func NewWSConn(conn *websocket.Conn) *WSConn {
 
 // this wrapper adds encryption to the websocket messages using nknorg/encrypted-stream
 func NewWSConnWithEncryption(conn *websocket.Conn, key [32]byte, initiator bool) io.ReadWriteCloser {
-	c := NewWSConn(conn)
+	return newEncryptedConn(NewWSConn(conn), key, initiator, false)
+}
+
+// sequentialNonce is only safe when the key is unique for every stream, such as a key from NewWSConnWithHandshake
+func newEncryptedConn(c *WSConn, key [32]byte, initiator bool, sequentialNonce bool) io.ReadWriteCloser {
 	encryptedConn, err := stream.NewEncryptedStream(c, &stream.Config{
 		Cipher:          stream.NewXSalsa20Poly1305Cipher(&key),
-		SequentialNonce: false,     // only when key is unique for every stream
-		Initiator:       initiator, // only on the dialer side
+		SequentialNonce: sequentialNonce, // only when key is unique for every stream
+		Initiator:       initiator,       // only on the dialer side
 	})
 	if err != nil {
 		panic(fmt.Sprintf("failed to create encrypted stream: %v", err))